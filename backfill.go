@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runBackfill decodes the raw lines in files with their original timestamps and loads the resulting measurements into bigquery with load jobs, leaving out measurements the table already has
+func runBackfill(files []string, controllerIDs []string) {
+
+	measurements := decodeBackfillFiles(files, controllerIDs)
+	if len(measurements) == 0 {
+		log.Info().Msgf("Found no measurements in %v", files)
+		return
+	}
+
+	sort.SliceStable(measurements, func(i, j int) bool {
+		return measurements[i].MeasuredAt.Before(measurements[j].MeasuredAt)
+	})
+	from := measurements[0].MeasuredAt
+	to := measurements[len(measurements)-1].MeasuredAt
+
+	log.Info().Msgf("Decoded %v measurements from %v until %v", len(measurements), from, to)
+
+	if *backfillDryRun {
+		return
+	}
+	if !*bigqueryEnable {
+		log.Warn().Msg("BigQuery is disabled, not loading any measurements")
+		return
+	}
+
+	bigqueryClient, err := NewBigQueryClient(*bigqueryProjectID, *bigqueryEnable)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed creating bigquery client")
+	}
+
+	err = createOrUpdateBigQueryTable(bigqueryClient, *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed preparing table %v.%v.%v", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	}
+
+	log.Info().Msgf("Retrieving measurements already in table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	existingMeasurements, err := bigqueryClient.QueryMeasurements(*bigqueryDataset, *bigqueryTable, from.Add(-*backfillMatchWindow), to.Add(*backfillMatchWindow))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed retrieving measurements from table %v.%v.%v", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	}
+
+	index := newBackfillIndex(*backfillMatchWindow)
+	for _, measurement := range existingMeasurements {
+		index.Add(measurement)
+	}
+
+	// skip measurements stored by the listener at the time, or that are in more than one of the files
+	rows := []BigQueryMeasurement{}
+	for _, measurement := range measurements {
+		row := toBigQueryMeasurement(measurement)
+		if index.Contains(row) {
+			continue
+		}
+		index.Add(row)
+		rows = append(rows, row)
+	}
+
+	log.Info().Msgf("Skipping %v measurements that are already in table %v.%v.%v", len(measurements)-len(rows), *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+
+	for start := 0; start < len(rows); start += *backfillBatchSize {
+		end := start + *backfillBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		log.Info().Msgf("Loading measurements %v to %v of %v into table %v.%v.%v...", start+1, end, len(rows), *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+		err := bigqueryClient.LoadMeasurements(*bigqueryDataset, *bigqueryTable, rows[start:end])
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed loading measurements into table %v.%v.%v; %v measurements were loaded before", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable, start)
+		}
+	}
+
+	log.Info().Msgf("Loaded %v measurements into table %v.%v.%v", len(rows), *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+}
+
+// decodeBackfillFiles runs the raw lines in files through the same frame processing as the listener and returns the measurements they produce; measurements from spool files are returned as they are
+func decodeBackfillFiles(files []string, controllerIDs []string) []Measurement {
+
+	measurementSink := &collectingMeasurementSink{}
+
+	// decoded messages can trigger follow-up requests, which are dropped since nothing gets sent
+	commandQueue := make(chan Command, 100)
+	go func() {
+		for range commandQueue {
+		}
+	}()
+	requestTracker := NewRequestTracker(commandQueue, *requestTimeout, *requestMaxAttempts)
+
+	// start from scratch like a replay does, so measurements only get the zone names the lines themselves hold
+	gatewayIdentity := NewGatewayIdentity(*gatewayID)
+	messageProcessors := map[string]MessageProcessor{}
+	for _, controllerID := range controllerIDs {
+		stateStore := NewStateStore(controllerID, *staleAfter)
+		stateStore.Restore(newInitialState())
+
+		// events are history by now, so there's no event sink
+		messageProcessors[controllerID] = NewMessageProcessor(controllerID, gatewayIdentity, measurementSink, nil, commandQueue, requestTracker, stateStore)
+	}
+	messageRouter := NewMessageRouter(controllerIDs, messageProcessors)
+	frameProcessor := NewFrameProcessor(messageRouter, messageProcessors[controllerIDs[0]], gatewayIdentity, NewFrameDeduplicator(*deduplicationWindow), nil)
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed opening %v", path)
+		}
+
+		lines, skipped := 0, 0
+
+		// the same frame is often logged more than once while it's processed
+		lastLogged := map[string]time.Time{}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines++
+
+			rawmsg, receivedAt, measurement, fromLog, ok := parseBackfillLine(scanner.Text())
+			if !ok {
+				skipped++
+				continue
+			}
+			if measurement != nil {
+				measurementSink.Write([]Measurement{*measurement})
+				continue
+			}
+
+			if fromLog {
+				if last, seen := lastLogged[rawmsg]; seen && receivedAt.Sub(last) < *deduplicationWindow {
+					continue
+				}
+				lastLogged[rawmsg] = receivedAt
+			}
+
+			frameProcessor.ProcessFrame(Frame{
+				Line:       rawmsg,
+				ReceivedAt: receivedAt,
+				Gateway:    path,
+			})
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			log.Fatal().Err(err).Msgf("Failed reading %v", path)
+		}
+
+		log.Info().Msgf("Read %v lines from %v, skipping %v lines without a timestamp", lines, path, skipped)
+	}
+	close(commandQueue)
+
+	return measurementSink.measurements
+}
+
+// parseBackfillLine returns the raw line and its timestamp from a capture line or a json log line with the raw line in the _msg field, or the measurement from a spool line
+func parseBackfillLine(line string) (rawmsg string, receivedAt time.Time, measurement *Measurement, fromLog bool, ok bool) {
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	if !strings.HasPrefix(line, "{") {
+		receivedAt, rawmsg, err := parseCaptureLine(line)
+		return rawmsg, receivedAt, nil, false, err == nil
+	}
+
+	var logEntry struct {
+		Msg       string `json:"_msg"`
+		Timestamp string `json:"timestamp"`
+		Time      string `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(line), &logEntry); err != nil {
+		return
+	}
+
+	if logEntry.Msg == "" {
+		var spooledMeasurement Measurement
+		if err := json.Unmarshal([]byte(line), &spooledMeasurement); err != nil || spooledMeasurement.Name == "" || spooledMeasurement.MeasuredAt.IsZero() {
+			return
+		}
+		return "", spooledMeasurement.MeasuredAt, &spooledMeasurement, false, true
+	}
+
+	timestamp := logEntry.Timestamp
+	if timestamp == "" {
+		timestamp = logEntry.Time
+	}
+	receivedAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return
+	}
+
+	return logEntry.Msg, receivedAt.UTC(), nil, true, true
+}
+
+// collectingMeasurementSink keeps all measurements written to it in memory
+type collectingMeasurementSink struct {
+	measurements []Measurement
+	mutex        sync.Mutex
+}
+
+func (cs *collectingMeasurementSink) Write(measurements []Measurement) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.measurements = append(cs.measurements, measurements...)
+	return nil
+}
+
+func (cs *collectingMeasurementSink) Close() error {
+	return nil
+}
+
+func (cs *collectingMeasurementSink) String() string {
+	return "backfill"
+}
+
+// backfillIndex finds measurements with the same values stored within window of each other, since the timestamps in logs differ slightly from the ones the listener stored
+type backfillIndex struct {
+	window  time.Duration
+	buckets map[string][]time.Time
+}
+
+func newBackfillIndex(window time.Duration) *backfillIndex {
+	if window <= 0 {
+		window = time.Microsecond
+	}
+	return &backfillIndex{
+		window:  window,
+		buckets: map[string][]time.Time{},
+	}
+}
+
+func (bi *backfillIndex) Add(row BigQueryMeasurement) {
+	key := bi.key(row, bi.bucket(row.InsertedAt))
+	bi.buckets[key] = append(bi.buckets[key], row.InsertedAt)
+}
+
+func (bi *backfillIndex) Contains(row BigQueryMeasurement) bool {
+	bucket := bi.bucket(row.InsertedAt)
+	for b := bucket - 1; b <= bucket+1; b++ {
+		for _, insertedAt := range bi.buckets[bi.key(row, b)] {
+			difference := row.InsertedAt.Sub(insertedAt)
+			if difference <= bi.window && difference >= -bi.window {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (bi *backfillIndex) bucket(insertedAt time.Time) int64 {
+	return insertedAt.UnixNano() / int64(bi.window)
+}
+
+// key leaves out the controller, since rows stored before multiple controllers were supported don't have it
+func (bi *backfillIndex) key(row BigQueryMeasurement, bucket int64) string {
+	zoneID := ""
+	if row.ZoneID.Valid {
+		zoneID = strconv.FormatInt(row.ZoneID.Int64, 10)
+	}
+	return strings.Join([]string{
+		row.Measurement.StringVal,
+		row.CommandType,
+		row.SourceID,
+		zoneID,
+		strconv.FormatFloat(row.Value.Float64, 'f', -1, 64),
+		strconv.FormatInt(bucket, 10),
+	}, "|")
+}
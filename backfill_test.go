@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestParseBackfillLine(t *testing.T) {
+
+	receivedAt := time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC)
+
+	tests := []struct {
+		name               string
+		line               string
+		expectedRawmsg     string
+		expectedReceivedAt time.Time
+		expectedName       string
+		expectedFromLog    bool
+		expectedOK         bool
+	}{
+		{
+			name:               "capture line",
+			line:               "2020-01-02T03:04:05.6Z 045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0",
+			expectedRawmsg:     "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0",
+			expectedReceivedAt: receivedAt,
+			expectedOK:         true,
+		},
+		{
+			name:               "json log with timestamp",
+			line:               `{"level":"info","_msg":"045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0","timestamp":"2020-01-02T04:04:05.6+01:00"}`,
+			expectedRawmsg:     "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0",
+			expectedReceivedAt: receivedAt,
+			expectedFromLog:    true,
+			expectedOK:         true,
+		},
+		{
+			name:               "json log with time",
+			line:               `{"level":"info","_msg":"045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0","time":"2020-01-02T03:04:05.6Z"}`,
+			expectedRawmsg:     "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0",
+			expectedReceivedAt: receivedAt,
+			expectedFromLog:    true,
+			expectedOK:         true,
+		},
+		{
+			name:               "spooled measurement",
+			line:               `{"Name":"temperature","Value":20,"ControllerID":"01:160371","MeasuredAt":"2020-01-02T03:04:05.6Z"}`,
+			expectedReceivedAt: receivedAt,
+			expectedName:       "temperature",
+			expectedOK:         true,
+		},
+		{
+			name: "json log without timestamp",
+			line: `{"level":"info","_msg":"045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0"}`,
+		},
+		{
+			name: "json log without raw line",
+			line: `{"level":"info","message":"Listening","time":"2020-01-02T03:04:05.6Z"}`,
+		},
+		{
+			name: "corrupt json",
+			line: `{"level":"info"`,
+		},
+		{
+			name: "empty line",
+			line: "  ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rawmsg, receivedAt, measurement, fromLog, ok := parseBackfillLine(test.line)
+
+			if ok != test.expectedOK {
+				t.Fatalf("expected ok %v, got %v", test.expectedOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if rawmsg != test.expectedRawmsg {
+				t.Errorf("expected raw line %v, got %v", test.expectedRawmsg, rawmsg)
+			}
+			if !receivedAt.Equal(test.expectedReceivedAt) {
+				t.Errorf("expected received at %v, got %v", test.expectedReceivedAt, receivedAt)
+			}
+			if fromLog != test.expectedFromLog {
+				t.Errorf("expected from log %v, got %v", test.expectedFromLog, fromLog)
+			}
+			if (measurement == nil && test.expectedName != "") || (measurement != nil && measurement.Name != test.expectedName) {
+				t.Errorf("expected measurement %v, got %v", test.expectedName, measurement)
+			}
+		})
+	}
+}
+
+func TestBackfillIndex(t *testing.T) {
+
+	insertedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	row := BigQueryMeasurement{
+		CommandType: "zone_temperature",
+		SourceID:    "01:160371",
+		ZoneID:      bigquery.NullInt64{Int64: 1, Valid: true},
+		Measurement: bigquery.NullString{StringVal: "temperature", Valid: true},
+		Value:       bigquery.NullFloat64{Float64: 20, Valid: true},
+		InsertedAt:  insertedAt,
+	}
+
+	tests := []struct {
+		name     string
+		update   func(row *BigQueryMeasurement)
+		expected bool
+	}{
+		{"same row", func(row *BigQueryMeasurement) {}, true},
+		{"within window before", func(row *BigQueryMeasurement) { row.InsertedAt = insertedAt.Add(-1900 * time.Millisecond) }, true},
+		{"within window after, in the next bucket", func(row *BigQueryMeasurement) { row.InsertedAt = insertedAt.Add(1999 * time.Millisecond) }, true},
+		{"outside window", func(row *BigQueryMeasurement) { row.InsertedAt = insertedAt.Add(2001 * time.Millisecond) }, false},
+		{"other value", func(row *BigQueryMeasurement) { row.Value.Float64 = 20.5 }, false},
+		{"other zone", func(row *BigQueryMeasurement) { row.ZoneID.Int64 = 2 }, false},
+		{"other measurement", func(row *BigQueryMeasurement) { row.Measurement.StringVal = "setpoint" }, false},
+		{"other controller", func(row *BigQueryMeasurement) {
+			row.ControllerID = bigquery.NullString{StringVal: "01:123456", Valid: true}
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := newBackfillIndex(2 * time.Second)
+			index.Add(row)
+
+			candidate := row
+			test.update(&candidate)
+
+			if actual := index.Contains(candidate); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type batchingMeasurementSinkImpl struct {
+	sink           MeasurementSink
+	name           string
+	batchSize      int
+	flushInterval  time.Duration
+	maxBackoff     time.Duration
+	maxBacklog     int
+	spoolPath      string
+	spoolFile      *os.File
+	spoolLines     int
+	unsyncedLines  int
+	deadLetterPath string
+	pending        []Measurement
+	dropped        int
+	flush          chan struct{}
+	stop           chan struct{}
+	done           chan struct{}
+	mutex          sync.Mutex
+}
+
+// NewBatchingMeasurementSink returns a MeasurementSink that buffers measurements and writes them to sink in batches of batchSize or every flushInterval from a background goroutine, retrying with backoff when writing fails; buffered measurements are spooled to a file in spoolDir so they survive restarts, unless spoolDir is empty, and batches the sink permanently rejects are dead-lettered to a file next to it
+func NewBatchingMeasurementSink(sink MeasurementSink, name string, batchSize int, flushInterval, maxBackoff time.Duration, maxBacklog int, spoolDir string) MeasurementSink {
+
+	bs := &batchingMeasurementSinkImpl{
+		sink:          sink,
+		name:          name,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxBackoff:    maxBackoff,
+		maxBacklog:    maxBacklog,
+		flush:         make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if spoolDir != "" {
+		bs.deadLetterPath = filepath.Join(spoolDir, name+".deadletter")
+		err := bs.openSpool(filepath.Join(spoolDir, name+".spool"))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed opening spool for %v, keeping measurements in memory only", sink)
+		}
+	}
+
+	go bs.run()
+
+	return bs
+}
+
+func (bs *batchingMeasurementSinkImpl) Write(measurements []Measurement) error {
+
+	if len(measurements) == 0 {
+		return nil
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	// write ahead to the spool, but keep the measurements in memory even when that fails; syncing it to disk is left to the background goroutine
+	var spoolErr error
+	if bs.spoolFile != nil {
+		data, err := encodeMeasurements(measurements)
+		if err == nil {
+			_, err = bs.spoolFile.Write(data)
+		}
+		if err == nil {
+			bs.spoolLines += len(measurements)
+			bs.unsyncedLines += len(measurements)
+		}
+		spoolErr = err
+	}
+
+	bs.pending = append(bs.pending, measurements...)
+	bs.trimBacklog()
+
+	// measurements dropped from the backlog are still in the spool, so rewrite it before it grows far beyond the backlog
+	if bs.spoolFile != nil && bs.maxBacklog > 0 && bs.spoolLines > 2*bs.maxBacklog {
+		if err := bs.rewriteSpool(); err != nil {
+			log.Warn().Err(err).Msgf("Failed rewriting spool %v, keeping measurements in memory only", bs.spoolPath)
+		}
+	}
+
+	if len(bs.pending) >= bs.batchSize || bs.unsyncedLines >= bs.batchSize {
+		select {
+		case bs.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return spoolErr
+}
+
+func (bs *batchingMeasurementSinkImpl) Close() error {
+
+	close(bs.stop)
+	<-bs.done
+
+	bs.mutex.Lock()
+	if bs.spoolFile != nil {
+		bs.spoolFile.Close()
+		bs.spoolFile = nil
+	}
+	bs.mutex.Unlock()
+
+	return bs.sink.Close()
+}
+
+func (bs *batchingMeasurementSinkImpl) String() string {
+	return bs.sink.String()
+}
+
+func (bs *batchingMeasurementSinkImpl) run() {
+
+	defer close(bs.done)
+
+	ticker := time.NewTicker(bs.flushInterval)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	var nextAttemptAt time.Time
+	for {
+		select {
+		case <-bs.stop:
+			// make a last attempt, anything left stays in the spool for the next run
+			bs.syncSpool()
+			if err := bs.flushPending(); err != nil {
+				log.Warn().Err(err).Msgf("Failed writing remaining measurements to %v before closing", bs.sink)
+			}
+			return
+		case <-ticker.C:
+		case <-bs.flush:
+		}
+
+		// sync the spool every interval or once a batch worth of measurements got appended, even while backing off
+		bs.syncSpool()
+
+		if time.Now().Before(nextAttemptAt) {
+			continue
+		}
+
+		err := bs.flushPending()
+		if err != nil {
+			if backoff == 0 {
+				backoff = bs.flushInterval
+			} else {
+				backoff *= 2
+			}
+			if backoff > bs.maxBackoff {
+				backoff = bs.maxBackoff
+			}
+			nextAttemptAt = time.Now().Add(backoff)
+
+			log.Warn().Err(err).Dur("backoff", backoff).Msgf("Failed writing measurements to %v, retrying...", bs.sink)
+			continue
+		}
+
+		backoff = 0
+	}
+}
+
+// flushPending writes all pending measurements in batches, stopping at the first failure that might pass when retried; batches the sink rejects permanently get dead-lettered
+func (bs *batchingMeasurementSinkImpl) flushPending() (err error) {
+
+	written := 0
+	defer func() {
+		if written > 0 {
+			bs.mutex.Lock()
+			if err := bs.rewriteSpool(); err != nil {
+				log.Warn().Err(err).Msgf("Failed rewriting spool %v, keeping measurements in memory only", bs.spoolPath)
+			}
+			bs.mutex.Unlock()
+		}
+	}()
+
+	for {
+		bs.mutex.Lock()
+		batch := make([]Measurement, minInt(bs.batchSize, len(bs.pending)))
+		copy(batch, bs.pending)
+		droppedBefore := bs.dropped
+		bs.mutex.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err = bs.sink.Write(batch)
+		if err != nil && isPermanentError(err) {
+			measurementFlushesTotal.WithLabelValues(bs.name, "dead_lettered").Inc()
+			bs.deadLetter(batch, err)
+			err = nil
+		} else if err != nil {
+			measurementFlushesTotal.WithLabelValues(bs.name, "failed").Inc()
+			return err
+		} else {
+			measurementFlushesTotal.WithLabelValues(bs.name, "success").Inc()
+		}
+
+		// new measurements only get appended, so the batch is still at the front unless part of it got dropped in the meantime
+		bs.mutex.Lock()
+		remove := len(batch) - (bs.dropped - droppedBefore)
+		if remove > 0 {
+			bs.pending = bs.pending[minInt(remove, len(bs.pending)):]
+		}
+		measurementBacklog.WithLabelValues(bs.name).Set(float64(len(bs.pending)))
+		bs.mutex.Unlock()
+
+		written += len(batch)
+	}
+}
+
+// deadLetter appends a batch the sink rejected to the dead-letter file, which has the same format as the spool so it can be loaded with backfill once the cause is fixed
+func (bs *batchingMeasurementSinkImpl) deadLetter(batch []Measurement, cause error) {
+
+	if bs.deadLetterPath == "" {
+		log.Error().Err(cause).Msgf("Dropped %v measurements rejected by %v", len(batch), bs.sink)
+		return
+	}
+
+	err := appendMeasurements(bs.deadLetterPath, batch)
+	if err != nil {
+		log.Error().Err(cause).Msgf("Dropped %v measurements rejected by %v, failed writing them to dead-letter file %v: %v", len(batch), bs.sink, bs.deadLetterPath, err)
+		return
+	}
+
+	log.Error().Err(cause).Msgf("Moved %v measurements rejected by %v to dead-letter file %v", len(batch), bs.sink, bs.deadLetterPath)
+}
+
+// syncSpool flushes the measurements appended to the spool since the last sync to disk
+func (bs *batchingMeasurementSinkImpl) syncSpool() {
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	if bs.spoolFile == nil || bs.unsyncedLines == 0 {
+		return
+	}
+
+	if err := bs.spoolFile.Sync(); err != nil {
+		log.Warn().Err(err).Msgf("Failed syncing spool %v", bs.spoolPath)
+		return
+	}
+	bs.unsyncedLines = 0
+}
+
+// trimBacklog drops the oldest measurements once the backlog grows beyond its maximum; needs to be called while holding the lock
+func (bs *batchingMeasurementSinkImpl) trimBacklog() {
+
+	if bs.maxBacklog > 0 && len(bs.pending) > bs.maxBacklog {
+		dropped := len(bs.pending) - bs.maxBacklog
+		bs.pending = bs.pending[dropped:]
+		bs.dropped += dropped
+		measurementsDroppedTotal.WithLabelValues(bs.name).Add(float64(dropped))
+		log.Warn().Msgf("Backlog for %v exceeds %v measurements, dropped the oldest %v", bs.sink, bs.maxBacklog, dropped)
+	}
+
+	measurementBacklog.WithLabelValues(bs.name).Set(float64(len(bs.pending)))
+}
+
+// openSpool recovers measurements left behind by a previous run and opens the spool for appending
+func (bs *batchingMeasurementSinkImpl) openSpool(spoolPath string) error {
+
+	if err := os.MkdirAll(filepath.Dir(spoolPath), 0755); err != nil {
+		return err
+	}
+
+	if file, err := os.Open(spoolPath); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var measurement Measurement
+			if err := json.Unmarshal(scanner.Bytes(), &measurement); err != nil {
+				log.Warn().Err(err).Msgf("Skipping corrupt line in spool %v", spoolPath)
+				continue
+			}
+			bs.pending = append(bs.pending, measurement)
+		}
+		file.Close()
+
+		if len(bs.pending) > 0 {
+			log.Info().Msgf("Recovered %v measurements for %v from spool %v", len(bs.pending), bs.sink, spoolPath)
+		}
+		bs.trimBacklog()
+	}
+
+	bs.spoolPath = spoolPath
+
+	// start from a clean spool with just the recovered measurements
+	return bs.rewriteSpool()
+}
+
+// rewriteSpool replaces the spool with the pending measurements; needs to be called while holding the lock
+func (bs *batchingMeasurementSinkImpl) rewriteSpool() error {
+
+	if bs.spoolPath == "" {
+		return nil
+	}
+
+	if bs.spoolFile != nil {
+		bs.spoolFile.Close()
+		bs.spoolFile = nil
+	}
+
+	data, err := encodeMeasurements(bs.pending)
+	if err == nil {
+		err = writeFileAtomically(bs.spoolPath, data)
+	}
+	if err != nil {
+		return err
+	}
+	bs.spoolLines = len(bs.pending)
+	bs.unsyncedLines = 0
+
+	bs.spoolFile, err = os.OpenFile(bs.spoolPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+
+	return err
+}
+
+// appendMeasurements appends the measurements to a file and syncs it, so they're on disk once it returns
+func appendMeasurements(path string, measurements []Measurement) error {
+
+	data, err := encodeMeasurements(measurements)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func encodeMeasurements(measurements []Measurement) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, measurement := range measurements {
+		if err := encoder.Encode(measurement); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
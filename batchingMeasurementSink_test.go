@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeBigQueryClient records inserted measurements and fails inserts with the queued errors first
+type fakeBigQueryClient struct {
+	errors   []error
+	attempts int
+	inserted []BigQueryMeasurement
+	mutex    sync.Mutex
+}
+
+func (fc *fakeBigQueryClient) CheckIfDatasetExists(dataset string) bool { return true }
+func (fc *fakeBigQueryClient) CheckIfTableExists(dataset, table string) bool {
+	return true
+}
+func (fc *fakeBigQueryClient) CreateTable(dataset, table string, typeForSchema interface{}, partitionField string, waitReady bool) error {
+	return nil
+}
+func (fc *fakeBigQueryClient) UpdateTableSchema(dataset, table string, typeForSchema interface{}) error {
+	return nil
+}
+func (fc *fakeBigQueryClient) DeleteTable(dataset, table string) error { return nil }
+func (fc *fakeBigQueryClient) LoadMeasurements(dataset, table string, measurements []BigQueryMeasurement) error {
+	return nil
+}
+func (fc *fakeBigQueryClient) QueryMeasurements(dataset, table string, from, to time.Time) ([]BigQueryMeasurement, error) {
+	return nil, nil
+}
+
+func (fc *fakeBigQueryClient) InsertMeasurements(dataset, table string, measurements []BigQueryMeasurement) error {
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.attempts++
+	if len(fc.errors) > 0 {
+		err := fc.errors[0]
+		fc.errors = fc.errors[1:]
+		if err != nil {
+			return err
+		}
+	}
+	fc.inserted = append(fc.inserted, measurements...)
+
+	return nil
+}
+
+func (fc *fakeBigQueryClient) counts() (attempts, inserted int) {
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.attempts, len(fc.inserted)
+}
+
+func newTestMeasurements(count int) []Measurement {
+
+	measurements := []Measurement{}
+	for i := 0; i < count; i++ {
+		measurements = append(measurements, Measurement{
+			Name:       measurementTemperature,
+			Value:      20 + float64(i)/10,
+			SourceID:   "04:000001",
+			MeasuredAt: time.Date(2019, 1, 1, 0, 0, i, 0, time.UTC),
+		})
+	}
+
+	return measurements
+}
+
+func countLines(t *testing.T, path string) int {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(data), "\n")
+}
+
+func waitUntil(t *testing.T, description string, condition func() bool) {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %v", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchingMeasurementSinkFlushes(t *testing.T) {
+
+	testCases := []struct {
+		name                string
+		batchSize           int
+		flushInterval       time.Duration
+		errors              []error
+		writes              int
+		expectedAttempts    int
+		expectedInserted    int
+		expectedDeadLetters int
+	}{
+		{name: "full batch is written right away", batchSize: 2, flushInterval: time.Hour, writes: 2, expectedAttempts: 1, expectedInserted: 2},
+		{name: "partial batch is written after the flush interval", batchSize: 100, flushInterval: 10 * time.Millisecond, writes: 1, expectedAttempts: 1, expectedInserted: 1},
+		{name: "batch is retried after a transient error", batchSize: 100, flushInterval: 10 * time.Millisecond, errors: []error{errors.New("connection reset"), &googleapi.Error{Code: 503}}, writes: 3, expectedAttempts: 3, expectedInserted: 3},
+		{name: "rate limited batch is retried", batchSize: 100, flushInterval: 10 * time.Millisecond, errors: []error{&googleapi.Error{Code: 429}}, writes: 1, expectedAttempts: 2, expectedInserted: 1},
+		{name: "rejected batch is dead-lettered", batchSize: 100, flushInterval: 10 * time.Millisecond, errors: []error{&googleapi.Error{Code: 400}}, writes: 2, expectedAttempts: 1, expectedDeadLetters: 2},
+		{name: "batch with invalid rows is dead-lettered", batchSize: 100, flushInterval: 10 * time.Millisecond, errors: []error{bigquery.PutMultiError{bigquery.RowInsertionError{Errors: bigquery.MultiError{errors.New("no such field")}}}}, writes: 1, expectedAttempts: 1, expectedDeadLetters: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			spoolDir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(spoolDir)
+
+			client := &fakeBigQueryClient{errors: tc.errors}
+			bigquerySink, err := NewBigQueryMeasurementSink(client, "project", "dataset", "table")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := NewBatchingMeasurementSink(bigquerySink, "bigquery", tc.batchSize, tc.flushInterval, 20*time.Millisecond, 100, spoolDir)
+
+			// act
+			for _, measurement := range newTestMeasurements(tc.writes) {
+				if err := sink.Write([]Measurement{measurement}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			waitUntil(t, "all attempts are made", func() bool {
+				attempts, _ := client.counts()
+				return attempts >= tc.expectedAttempts
+			})
+			waitUntil(t, "the spool is empty", func() bool {
+				return countLines(t, filepath.Join(spoolDir, "bigquery.spool")) == 0
+			})
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			attempts, inserted := client.counts()
+			if attempts != tc.expectedAttempts {
+				t.Errorf("expected %v attempts, got %v", tc.expectedAttempts, attempts)
+			}
+			if inserted != tc.expectedInserted {
+				t.Errorf("expected %v inserted measurements, got %v", tc.expectedInserted, inserted)
+			}
+			deadLetters := 0
+			if tc.expectedDeadLetters > 0 {
+				deadLetters = countLines(t, filepath.Join(spoolDir, "bigquery.deadletter"))
+			} else if fileExists(filepath.Join(spoolDir, "bigquery.deadletter")) {
+				t.Errorf("expected no dead-letter file")
+			}
+			if deadLetters != tc.expectedDeadLetters {
+				t.Errorf("expected %v dead-lettered measurements, got %v", tc.expectedDeadLetters, deadLetters)
+			}
+		})
+	}
+}
+
+func TestBatchingMeasurementSinkReplaysSpool(t *testing.T) {
+
+	spoolDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	// the first run can't reach bigquery at all, so the measurements stay in the spool
+	failingClient := &fakeBigQueryClient{errors: []error{errors.New("unreachable"), errors.New("unreachable")}}
+	failingSink, _ := NewBigQueryMeasurementSink(failingClient, "project", "dataset", "table")
+	sink := NewBatchingMeasurementSink(failingSink, "bigquery", 100, time.Hour, time.Hour, 100, spoolDir)
+	if err := sink.Write(newTestMeasurements(3)); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	if _, inserted := failingClient.counts(); inserted != 0 {
+		t.Fatalf("expected no inserted measurements in the first run, got %v", inserted)
+	}
+
+	// act
+	client := &fakeBigQueryClient{}
+	bigquerySink, _ := NewBigQueryMeasurementSink(client, "project", "dataset", "table")
+	sink = NewBatchingMeasurementSink(bigquerySink, "bigquery", 100, time.Hour, time.Hour, 100, spoolDir)
+	sink.Close()
+
+	if _, inserted := client.counts(); inserted != 3 {
+		t.Errorf("expected the 3 spooled measurements to be inserted after the restart, got %v", inserted)
+	}
+	if lines := countLines(t, filepath.Join(spoolDir, "bigquery.spool")); lines != 0 {
+		t.Errorf("expected an empty spool, got %v lines", lines)
+	}
+}
+
+func TestBatchingMeasurementSinkBoundsSpool(t *testing.T) {
+
+	spoolDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	errs := []error{}
+	for i := 0; i < 10; i++ {
+		errs = append(errs, errors.New("unreachable"))
+	}
+	client := &fakeBigQueryClient{errors: errs}
+	bigquerySink, _ := NewBigQueryMeasurementSink(client, "project", "dataset", "table")
+	sink := NewBatchingMeasurementSink(bigquerySink, "bigquery", 100, time.Hour, time.Hour, 3, spoolDir)
+
+	// act
+	for _, measurement := range newTestMeasurements(20) {
+		if err := sink.Write([]Measurement{measurement}); err != nil {
+			t.Fatal(err)
+		}
+		if lines := countLines(t, filepath.Join(spoolDir, "bigquery.spool")); lines > 6 {
+			t.Fatalf("expected the spool to stay within twice the backlog, got %v lines", lines)
+		}
+	}
+	sink.Close()
+
+	// only the newest measurements within the backlog are kept
+	client = &fakeBigQueryClient{}
+	bigquerySink, _ = NewBigQueryMeasurementSink(client, "project", "dataset", "table")
+	NewBatchingMeasurementSink(bigquerySink, "bigquery", 100, time.Hour, time.Hour, 3, spoolDir).Close()
+
+	if len(client.inserted) != 3 || client.inserted[2].Value.Float64 != 21.9 {
+		t.Errorf("expected the newest 3 measurements to be inserted, got %+v", client.inserted)
+	}
+}
+
+func TestBatchingMeasurementSinkSyncsSpool(t *testing.T) {
+
+	testCases := []struct {
+		name                  string
+		batchSize             int
+		flushInterval         time.Duration
+		writes                int
+		expectedUnsyncedLines int
+	}{
+		{name: "appended measurements aren't synced right away", batchSize: 100, flushInterval: time.Hour, writes: 1, expectedUnsyncedLines: 1},
+		{name: "appended measurements are synced after the flush interval", batchSize: 100, flushInterval: 10 * time.Millisecond, writes: 1, expectedUnsyncedLines: 0},
+		{name: "full batch is synced right away", batchSize: 2, flushInterval: time.Hour, writes: 2, expectedUnsyncedLines: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			spoolDir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(spoolDir)
+
+			// bigquery stays unreachable, so the spool doesn't get rewritten after a flush
+			errs := []error{}
+			for i := 0; i < 100; i++ {
+				errs = append(errs, errors.New("unreachable"))
+			}
+			client := &fakeBigQueryClient{errors: errs}
+			bigquerySink, _ := NewBigQueryMeasurementSink(client, "project", "dataset", "table")
+			sink := NewBatchingMeasurementSink(bigquerySink, "bigquery", tc.batchSize, tc.flushInterval, time.Hour, 100, spoolDir).(*batchingMeasurementSinkImpl)
+			defer sink.Close()
+
+			unsyncedLines := func() int {
+				sink.mutex.Lock()
+				defer sink.mutex.Unlock()
+				return sink.unsyncedLines
+			}
+
+			// act
+			for _, measurement := range newTestMeasurements(tc.writes) {
+				if err := sink.Write([]Measurement{measurement}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tc.expectedUnsyncedLines > 0 {
+				if lines := unsyncedLines(); lines != tc.expectedUnsyncedLines {
+					t.Errorf("expected %v unsynced lines, got %v", tc.expectedUnsyncedLines, lines)
+				}
+			} else {
+				waitUntil(t, "the spool is synced", func() bool {
+					return unsyncedLines() == 0
+				})
+			}
+			if lines := countLines(t, filepath.Join(spoolDir, "bigquery.spool")); lines != tc.writes {
+				t.Errorf("expected %v lines in the spool, got %v", tc.writes, lines)
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
 )
 
 // BigQueryClient is the interface for connecting to bigquery
@@ -16,6 +21,8 @@ type BigQueryClient interface {
 	UpdateTableSchema(dataset, table string, typeForSchema interface{}) error
 	DeleteTable(dataset, table string) error
 	InsertMeasurements(dataset, table string, measurements []BigQueryMeasurement) error
+	LoadMeasurements(dataset, table string, measurements []BigQueryMeasurement) error
+	QueryMeasurements(dataset, table string, from, to time.Time) ([]BigQueryMeasurement, error)
 }
 
 type bigQueryClientImpl struct {
@@ -26,6 +33,13 @@ type bigQueryClientImpl struct {
 // NewBigQueryClient returns new BigQueryClient
 func NewBigQueryClient(projectID string, enable bool) (BigQueryClient, error) {
 
+	// skip connecting so the application can run without google cloud credentials
+	if !enable {
+		return &bigQueryClientImpl{
+			enable: enable,
+		}, nil
+	}
+
 	ctx := context.Background()
 
 	bigqueryClient, err := bigquery.NewClient(ctx, projectID)
@@ -77,8 +91,7 @@ func (bqc *bigQueryClientImpl) CreateTable(dataset, table string, typeForSchema
 
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	// infer the schema of the type
-	schema, err := bigquery.InferSchema(typeForSchema)
+	schema, err := toSchema(typeForSchema)
 	if err != nil {
 		return err
 	}
@@ -120,8 +133,7 @@ func (bqc *bigQueryClientImpl) UpdateTableSchema(dataset, table string, typeForS
 
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	// infer the schema of the type
-	schema, err := bigquery.InferSchema(typeForSchema)
+	schema, err := toSchema(typeForSchema)
 	if err != nil {
 		return err
 	}
@@ -169,9 +181,172 @@ func (bqc *bigQueryClientImpl) InsertMeasurements(dataset, table string, measure
 
 	u := tbl.Uploader()
 
-	if err := u.Put(context.Background(), measurements); err != nil {
+	// set an insert id derived from the measurement, so bigquery can drop duplicates when a batch is retried
+	savers := make([]*bigquery.StructSaver, 0, len(measurements))
+	for _, measurement := range measurements {
+		savers = append(savers, &bigquery.StructSaver{
+			Struct:   measurement,
+			InsertID: fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%+v", measurement)))),
+		})
+	}
+
+	if err := u.Put(context.Background(), savers); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// LoadMeasurements appends the measurements to the table with a load job, which unlike streaming inserts is free and makes the rows available for updates and deletes right away
+func (bqc *bigQueryClientImpl) LoadMeasurements(dataset, table string, measurements []BigQueryMeasurement) error {
+
+	if !bqc.enable {
+		return nil
+	}
+
+	schema := toBigQuerySchema(measurementColumns)
+
+	// newline delimited json keeps empty strings apart from null, unlike csv
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, measurement := range measurements {
+		row, _, err := (&bigquery.StructSaver{Struct: measurement, Schema: schema}).Save()
+		if err != nil {
+			return err
+		}
+
+		record := map[string]interface{}{}
+		for name, value := range row {
+			v := unwrapBigQueryValue(value)
+			if t, ok := v.(time.Time); ok {
+				v = t.UTC().Format("2006-01-02 15:04:05.999999-07:00")
+			}
+			record[name] = v
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	source := bigquery.NewReaderSource(&data)
+	source.SourceFormat = bigquery.JSON
+	source.Schema = schema
+
+	loader := bqc.client.Dataset(dataset).Table(table).LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteAppend
+
+	ctx := context.Background()
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// QueryMeasurements returns the measurements inserted between from and to, with measurement and value derived from the demand, temperature and setpoint columns for rows inserted before those columns existed
+func (bqc *bigQueryClientImpl) QueryMeasurements(dataset, table string, from, to time.Time) ([]BigQueryMeasurement, error) {
+
+	if !bqc.enable {
+		return nil, nil
+	}
+
+	q := bqc.client.Query(fmt.Sprintf(`
+		SELECT
+			message_type,
+			command_type,
+			source_type,
+			source_id,
+			destination_type,
+			destination_id,
+			broadcast,
+			zone_id,
+			zone_name,
+			inserted_at,
+			controller_id,
+			COALESCE(measurement, CASE
+				WHEN demand_percentage IS NOT NULL THEN 'demand_percentage'
+				WHEN temperature IS NOT NULL THEN 'temperature'
+				WHEN setpoint IS NOT NULL THEN 'setpoint'
+			END) AS measurement,
+			COALESCE(value, demand_percentage, temperature, setpoint) AS value
+		FROM
+			`+"`%v`"+`
+		WHERE
+			inserted_at BETWEEN @from AND @to`, table))
+	q.DefaultDatasetID = dataset
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from},
+		{Name: "to", Value: to},
+	}
+
+	it, err := q.Read(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	measurements := []BigQueryMeasurement{}
+	for {
+		var measurement BigQueryMeasurement
+		err := it.Next(&measurement)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		measurements = append(measurements, measurement)
+	}
+
+	return measurements, nil
+}
+
+// toSchema returns typeForSchema if it's a schema already and otherwise infers the schema of the type
+func toSchema(typeForSchema interface{}) (bigquery.Schema, error) {
+
+	if schema, ok := typeForSchema.(bigquery.Schema); ok {
+		return schema, nil
+	}
+
+	return bigquery.InferSchema(typeForSchema)
+}
+
+// unwrapBigQueryValue unwraps the bigquery null types into plain values or nil, which the json encoder writes as they are
+func unwrapBigQueryValue(value bigquery.Value) interface{} {
+
+	switch v := value.(type) {
+	case bigquery.NullString:
+		if !v.Valid {
+			return nil
+		}
+		return v.StringVal
+	case bigquery.NullInt64:
+		if !v.Valid {
+			return nil
+		}
+		return v.Int64
+	case bigquery.NullFloat64:
+		if !v.Valid {
+			return nil
+		}
+		return v.Float64
+	case bigquery.NullBool:
+		if !v.Valid {
+			return nil
+		}
+		return v.Bool
+	case bigquery.NullTimestamp:
+		if !v.Valid {
+			return nil
+		}
+		return v.Timestamp
+	}
+
+	return value
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/googleapi"
+)
+
+type bigqueryMeasurementSinkImpl struct {
+	bigqueryClient BigQueryClient
+	projectID      string
+	dataset        string
+	table          string
+}
+
+// NewBigQueryMeasurementSink returns a MeasurementSink inserting measurements into a BigQuery table, creating or updating the table if needed
+func NewBigQueryMeasurementSink(bigqueryClient BigQueryClient, projectID, dataset, table string) (MeasurementSink, error) {
+
+	err := createOrUpdateBigQueryTable(bigqueryClient, projectID, dataset, table)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bigqueryMeasurementSinkImpl{
+		bigqueryClient: bigqueryClient,
+		projectID:      projectID,
+		dataset:        dataset,
+		table:          table,
+	}, nil
+}
+
+func (bs *bigqueryMeasurementSinkImpl) Write(measurements []Measurement) error {
+
+	bigqueryMeasurements := make([]BigQueryMeasurement, 0, len(measurements))
+	for _, measurement := range measurements {
+		bigqueryMeasurements = append(bigqueryMeasurements, toBigQueryMeasurement(measurement))
+	}
+
+	return classifyBigQueryError(bs.bigqueryClient.InsertMeasurements(bs.dataset, bs.table, bigqueryMeasurements))
+}
+
+func (bs *bigqueryMeasurementSinkImpl) Close() error {
+	return nil
+}
+
+func (bs *bigqueryMeasurementSinkImpl) String() string {
+	return fmt.Sprintf("bigquery table %v.%v.%v", bs.projectID, bs.dataset, bs.table)
+}
+
+// createOrUpdateBigQueryTable creates the measurements table partitioned on inserted_at if it doesn't exist yet and otherwise updates its schema to the current measurement
+func createOrUpdateBigQueryTable(bigqueryClient BigQueryClient, projectID, dataset, table string) error {
+
+	log.Debug().Msgf("Checking if table %v.%v.%v exists...", projectID, dataset, table)
+	tableExist := bigqueryClient.CheckIfTableExists(dataset, table)
+	if !tableExist {
+		log.Debug().Msgf("Creating table %v.%v.%v...", projectID, dataset, table)
+		err := bigqueryClient.CreateTable(dataset, table, toBigQuerySchema(measurementColumns), "inserted_at", true)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Debug().Msgf("Trying to update table %v.%v.%v schema...", projectID, dataset, table)
+		err := bigqueryClient.UpdateTableSchema(dataset, table, toBigQuerySchema(measurementColumns))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// classifyBigQueryError marks rows rejected by bigquery and client errors other than timeouts and rate limiting as permanent
+func classifyBigQueryError(err error) error {
+
+	switch e := err.(type) {
+	case bigquery.PutMultiError:
+		return newPermanentError(e)
+	case *googleapi.Error:
+		if isPermanentHTTPStatus(e.Code) {
+			return newPermanentError(e)
+		}
+	}
+
+	return err
+}
+
+// toBigQuerySchema maps the measurement columns onto a bigquery schema
+func toBigQuerySchema(columns []measurementColumn) bigquery.Schema {
+
+	fieldTypes := map[measurementColumnType]bigquery.FieldType{
+		columnTypeString:    bigquery.StringFieldType,
+		columnTypeInteger:   bigquery.IntegerFieldType,
+		columnTypeFloat:     bigquery.FloatFieldType,
+		columnTypeBoolean:   bigquery.BooleanFieldType,
+		columnTypeTimestamp: bigquery.TimestampFieldType,
+	}
+
+	schema := bigquery.Schema{}
+	for _, column := range columns {
+		schema = append(schema, &bigquery.FieldSchema{
+			Name:     column.Name,
+			Type:     fieldTypes[column.Type],
+			Required: column.Required,
+		})
+	}
+
+	return schema
+}
+
+// toBigQueryMeasurement maps a measurement onto a row with the measurement columns, since rows get inserted, loaded and queried as struct
+func toBigQueryMeasurement(measurement Measurement) BigQueryMeasurement {
+
+	row := BigQueryMeasurement{
+		MessageType:     measurement.MessageType,
+		CommandType:     measurement.CommandType,
+		SourceType:      measurement.SourceType,
+		SourceID:        measurement.SourceID,
+		DestinationType: measurement.DestinationType,
+		DestinationID:   measurement.DestinationID,
+		Broadcast:       measurement.Broadcast,
+		ZoneName:        bigquery.NullString{StringVal: measurement.ZoneName, Valid: measurement.ZoneName != ""},
+		InsertedAt:      measurement.MeasuredAt,
+		ControllerID:    bigquery.NullString{StringVal: measurement.ControllerID, Valid: measurement.ControllerID != ""},
+		Measurement:     bigquery.NullString{StringVal: measurement.Name, Valid: true},
+		Value:           bigquery.NullFloat64{Float64: measurement.Value, Valid: true},
+	}
+
+	if measurement.ZoneID != nil {
+		row.ZoneID = bigquery.NullInt64{Int64: *measurement.ZoneID, Valid: true}
+	}
+
+	switch measurement.Name {
+	case measurementDemandPercentage:
+		row.DemandPercentage = bigquery.NullFloat64{Float64: measurement.Value, Valid: true}
+	case measurementTemperature:
+		row.Temperature = bigquery.NullFloat64{Float64: measurement.Value, Valid: true}
+	case measurementSetpoint:
+		row.Setpoint = bigquery.NullFloat64{Float64: measurement.Value, Valid: true}
+	}
+
+	return row
+}
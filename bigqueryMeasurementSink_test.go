@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestToBigQueryMeasurementMatchesMeasurementColumns(t *testing.T) {
+
+	// rows are inserted as struct, so the struct has to stay in line with the columns the table gets created with
+	inferredSchema, err := bigquery.InferSchema(BigQueryMeasurement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := toBigQuerySchema(measurementColumns)
+	if len(inferredSchema) != len(schema) {
+		t.Fatalf("expected %v fields, got %v", len(schema), len(inferredSchema))
+	}
+	for i, field := range schema {
+		if inferredSchema[i].Name != field.Name || inferredSchema[i].Type != field.Type || inferredSchema[i].Required != field.Required {
+			t.Errorf("expected field %+v, got %+v", field, inferredSchema[i])
+		}
+	}
+
+	zoneID := int64(3)
+	measurements := []Measurement{
+		{Name: measurementSetpoint, Value: 19.5, ControllerID: "01:160371", ZoneID: &zoneID, ZoneName: "Bedroom", MessageType: "I", CommandType: "setpoint", SourceType: "CTL", SourceID: "01:160371", DestinationType: "CTL", DestinationID: "01:160371", Broadcast: true, MeasuredAt: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: measurementBatteryLow, Value: 1, SourceType: "TRV", SourceID: "04:000001", MeasuredAt: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, measurement := range measurements {
+		row, _, err := (&bigquery.StructSaver{Struct: toBigQueryMeasurement(measurement), Schema: inferredSchema}).Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range measurementColumns {
+			if actual, expected := unwrapBigQueryValue(row[column.Name]), column.Value(measurement); actual != expected {
+				t.Errorf("expected %v of %v to be %#v, got %#v", column.Name, measurement.Name, expected, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CaptureWriter is the interface for recording every raw line received from the gateway
+type CaptureWriter interface {
+	Write(line string, receivedAt time.Time) error
+	Close() error
+}
+
+type captureWriterImpl struct {
+	filePath    string
+	maxFileSize int64
+	maxFiles    int
+	file        *os.File
+	fileSize    int64
+	mutex       sync.Mutex
+}
+
+// NewCaptureWriter returns a CaptureWriter that rotates the capture file once it reaches maxFileSize bytes, keeping at most maxFiles rotated files
+func NewCaptureWriter(filePath string, maxFileSize int64, maxFiles int) (CaptureWriter, error) {
+
+	cw := &captureWriterImpl{
+		filePath:    filePath,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}
+
+	err := cw.openFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (cw *captureWriterImpl) Write(line string, receivedAt time.Time) error {
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	if cw.maxFileSize > 0 && cw.fileSize >= cw.maxFileSize {
+		err := cw.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := fmt.Fprintf(cw.file, "%v %v\n", receivedAt.UTC().Format(time.RFC3339Nano), line)
+	cw.fileSize += int64(n)
+
+	return err
+}
+
+func (cw *captureWriterImpl) Close() error {
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	return cw.file.Close()
+}
+
+func (cw *captureWriterImpl) openFile() error {
+
+	file, err := os.OpenFile(cw.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	cw.file = file
+	cw.fileSize = info.Size()
+
+	return nil
+}
+
+// rotate renames the current file with a timestamp suffix in nanoseconds and removes the oldest rotated files
+func (cw *captureWriterImpl) rotate() error {
+
+	err := cw.file.Close()
+	if err != nil {
+		return err
+	}
+
+	// rotating twice within the same nanosecond is unlikely, but would silently overwrite the previous file
+	timestamp := time.Now().UTC().Format("20060102T150405.000000000")
+	rotatedFilePath := fmt.Sprintf("%v.%v", cw.filePath, timestamp)
+	for i := 1; fileExists(rotatedFilePath); i++ {
+		rotatedFilePath = fmt.Sprintf("%v.%v.%v", cw.filePath, timestamp, i)
+	}
+
+	err = os.Rename(cw.filePath, rotatedFilePath)
+	if err != nil {
+		return err
+	}
+
+	rotatedFiles, err := filepath.Glob(cw.filePath + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(rotatedFiles)
+	for len(rotatedFiles) > cw.maxFiles {
+		os.Remove(rotatedFiles[0])
+		rotatedFiles = rotatedFiles[1:]
+	}
+
+	return cw.openFile()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureWriterRotatesWithoutOverwriting(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "capture.log")
+	captureWriter, err := NewCaptureWriter(filePath, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every write beyond the first rotates the file, well within the same second
+	for i := 0; i < 5; i++ {
+		err := captureWriter.Write("045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	captureWriter.Close()
+
+	rotatedFiles, err := filepath.Glob(filePath + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotatedFiles) != 4 {
+		t.Errorf("expected 4 rotated files, got %v", rotatedFiles)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+type configMapStatePersisterImpl struct {
+	kubeClient    *k8s.Client
+	namespace     string
+	configMapName string
+	key           string
+}
+
+// NewConfigMapStatePersister returns a StatePersister storing state in a Kubernetes configmap, to be used by the evohome-bigquery-exporter and on restarts
+func NewConfigMapStatePersister(namespace, configMapName, key string) (StatePersister, error) {
+
+	kubeClient, err := k8s.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &configMapStatePersisterImpl{
+		kubeClient:    kubeClient,
+		namespace:     namespace,
+		configMapName: configMapName,
+		key:           key,
+	}, nil
+}
+
+func (cp *configMapStatePersisterImpl) Load() (*State, error) {
+
+	var configMap corev1.ConfigMap
+	err := cp.kubeClient.Get(context.Background(), cp.namespace, cp.configMapName, &configMap)
+	if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := configMap.Data[cp.key]
+	if !ok || data == "" {
+		return nil, nil
+	}
+
+	return unmarshalState([]byte(data)), nil
+}
+
+func (cp *configMapStatePersisterImpl) Store(state State) error {
+
+	// retrieve configmap
+	var configMap corev1.ConfigMap
+	err := cp.kubeClient.Get(context.Background(), cp.namespace, cp.configMapName, &configMap)
+	if err != nil {
+		return err
+	}
+
+	// marshal state to json
+	stateData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+
+	configMap.Data[cp.key] = string(stateData)
+
+	// update configmap to have state available when the application runs the next time and for other applications
+	return cp.kubeClient.Update(context.Background(), &configMap)
+}
+
+func (cp *configMapStatePersisterImpl) String() string {
+	return fmt.Sprintf("configmap %v/%v key %v", cp.namespace, cp.configMapName, cp.key)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectionSupervisor is the interface for owning the transport, reconnecting it when reads fail or the line goes silent
+type ConnectionSupervisor interface {
+	LineWriter
+	Start()
+	Stop()
+	Frames() <-chan Frame
+}
+
+type writeRequest struct {
+	line   string
+	result chan error
+}
+
+type connectionSupervisorImpl struct {
+	transport      Transport
+	silenceTimeout time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	frames         chan Frame
+	writeRequests  chan writeRequest
+	stop           chan struct{}
+	reconnects     int
+}
+
+// NewConnectionSupervisor returns new ConnectionSupervisor
+func NewConnectionSupervisor(transport Transport, silenceTimeout, minBackoff, maxBackoff time.Duration) ConnectionSupervisor {
+	return &connectionSupervisorImpl{
+		transport:      transport,
+		silenceTimeout: silenceTimeout,
+		minBackoff:     minBackoff,
+		maxBackoff:     maxBackoff,
+		frames:         make(chan Frame, 100),
+		writeRequests:  make(chan writeRequest),
+		stop:           make(chan struct{}),
+	}
+}
+
+func (cs *connectionSupervisorImpl) Start() {
+	go cs.run()
+}
+
+func (cs *connectionSupervisorImpl) Stop() {
+	close(cs.stop)
+}
+
+func (cs *connectionSupervisorImpl) Frames() <-chan Frame {
+	return cs.frames
+}
+
+func (cs *connectionSupervisorImpl) WriteLine(line string) error {
+
+	// hand the line to the goroutine owning the transport and wait for the outcome
+	request := writeRequest{
+		line:   line,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case cs.writeRequests <- request:
+		return <-request.result
+	case <-cs.stop:
+		return errors.New("Connection supervisor is stopped")
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("Timed out waiting for %v to accept write", cs.transport)
+	}
+}
+
+func (cs *connectionSupervisorImpl) run() {
+
+	defer close(cs.frames)
+
+	for {
+		if !cs.connect() {
+			return
+		}
+
+		reason := cs.readUntilFailure()
+		cs.transport.Close()
+
+		if reason == "" {
+			return
+		}
+
+		cs.reconnects++
+		transportReconnectsTotal.WithLabelValues(reason).Inc()
+		log.Warn().
+			Int("reconnects", cs.reconnects).
+			Str("reason", reason).
+			Msgf("Reconnecting %v...", cs.transport)
+	}
+}
+
+// connect opens the transport, backing off exponentially while it fails; returns false when stopped in the meantime
+func (cs *connectionSupervisorImpl) connect() bool {
+
+	backoff := cs.minBackoff
+	for {
+		err := cs.transport.Open()
+		if err == nil {
+			log.Info().Msgf("Connected to %v", cs.transport)
+			return true
+		}
+
+		log.Warn().Err(err).Dur("backoff", backoff).Msgf("Failed opening %v, retrying...", cs.transport)
+
+		select {
+		case <-cs.stop:
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > cs.maxBackoff {
+			backoff = cs.maxBackoff
+		}
+	}
+}
+
+// readUntilFailure passes on received lines and handles writes until the transport fails or goes silent, returning the reason or an empty string when it's done
+func (cs *connectionSupervisorImpl) readUntilFailure() (reason string) {
+
+	lastReceivedAt := time.Now()
+	for {
+		select {
+		case <-cs.stop:
+			return ""
+		case request := <-cs.writeRequests:
+			request.result <- cs.transport.WriteLine(request.line)
+			continue
+		default:
+		}
+
+		line, receivedAt, err := cs.transport.ReadLine()
+		switch {
+		case err == nil:
+			if silentPeriod := time.Since(lastReceivedAt); silentPeriod > time.Minute {
+				transportSilentPeriodSeconds.Observe(silentPeriod.Seconds())
+				log.Info().Dur("silentPeriod", silentPeriod).Msgf("Received line from %v after silent period", cs.transport)
+			}
+			lastReceivedAt = time.Now()
+			cs.frames <- Frame{
+				Line:       line,
+				ReceivedAt: receivedAt,
+				Gateway:    cs.transport.String(),
+			}
+
+		case err == errTransportFinished:
+			return ""
+
+		case err == errLineTooLong:
+			log.Warn().Err(err).Msgf("Message is too long for buffer, skipping it")
+
+		case err == io.EOF:
+			silentPeriod := time.Since(lastReceivedAt)
+			if silentPeriod > cs.silenceTimeout {
+				transportSilentPeriodSeconds.Observe(silentPeriod.Seconds())
+				log.Warn().Dur("silentPeriod", silentPeriod).Msgf("Received last line from %v more than %v ago", cs.transport, cs.silenceTimeout)
+				return "silence"
+			}
+
+		default:
+			log.Warn().Err(err).Msgf("Error reading from %v", cs.transport)
+			return "error"
+		}
+	}
+}
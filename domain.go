@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ var commandsMap = map[string]string{
 	"0006": "schedule_sync",
 	"0008": "relay_heat_demand",
 	"000A": "zone_info",
+	"000C": "zone_devices",
 	"0100": "other_command",
 	"0418": "device_info",
 	"1060": "battery_info",
@@ -37,6 +39,61 @@ var commandsMap = map[string]string{
 
 var reverseCommandsMap = reverseMap(commandsMap)
 
+var controllerModeMap = map[string]string{
+	"00": "auto",
+	"01": "heating_off",
+	"02": "eco",
+	"03": "away",
+	"04": "day_off",
+	"05": "day_off_eco",
+	"06": "auto_with_reset",
+	"07": "custom",
+}
+
+var reverseControllerModeMap = reverseMap(controllerModeMap)
+
+var dhwModeMap = map[string]string{
+	"00": "follow_schedule",
+	"01": "advanced_override",
+	"02": "permanent_override",
+	"04": "temporary_override",
+}
+
+var reverseDhwModeMap = reverseMap(dhwModeMap)
+
+var zoneModeMap = map[string]string{
+	"00": "follow_schedule",
+	"01": "advanced_override",
+	"02": "permanent_override",
+	"03": "countdown_override",
+	"04": "temporary_override",
+}
+
+var reverseZoneModeMap = reverseMap(zoneModeMap)
+
+var faultStateMap = map[string]string{
+	"00": "fault",
+	"40": "restore",
+}
+
+var faultTypeMap = map[string]string{
+	"01": "system_fault",
+	"03": "mains_low",
+	"04": "battery_low",
+	"05": "battery_error",
+	"06": "comms_fault",
+	"07": "sensor_fault",
+	"0A": "sensor_error",
+}
+
+var faultDeviceClassMap = map[string]string{
+	"00": "controller",
+	"01": "sensor",
+	"04": "actuator",
+	"05": "dhw_actuator",
+	"06": "rf_gateway",
+}
+
 var deviceTypeMap = map[string]string{
 	"01": "CTL",  // controller (evohome touch)
 	"02": "UFH",  // underfloor heating (HCE80)
@@ -63,6 +120,36 @@ type BigQueryMeasurement struct {
 	Temperature      bigquery.NullFloat64 `bigquery:"temperature"`
 	Setpoint         bigquery.NullFloat64 `bigquery:"setpoint"`
 	InsertedAt       time.Time            `bigquery:"inserted_at"`
+	ControllerID     bigquery.NullString  `bigquery:"controller_id"`
+	Measurement      bigquery.NullString  `bigquery:"measurement"`
+	Value            bigquery.NullFloat64 `bigquery:"value"`
+}
+
+const (
+	measurementDemandPercentage = "demand_percentage"
+	measurementTemperature      = "temperature"
+	measurementSetpoint         = "setpoint"
+	measurementDhwTemperature   = "dhw_temperature"
+	measurementDhwSetpoint      = "dhw_setpoint"
+	measurementBatteryLevel     = "battery_level"
+	measurementBatteryLow       = "battery_low"
+)
+
+// Measurement is a storage neutral value decoded from a message, like a zone's heat demand or a device's battery level
+type Measurement struct {
+	Name            string
+	Value           float64
+	ControllerID    string
+	ZoneID          *int64
+	ZoneName        string
+	MessageType     string
+	CommandType     string
+	SourceType      string
+	SourceID        string
+	DestinationType string
+	DestinationID   string
+	Broadcast       bool
+	MeasuredAt      time.Time
 }
 
 type Command struct {
@@ -71,6 +158,8 @@ type Command struct {
 	broadcast     bool
 	destinationID string
 	payload       Payload
+	interactive   bool
+	attempt       int
 }
 
 type Payload interface {
@@ -96,6 +185,82 @@ func (p DefaultPayload) GetPayloadHex() string {
 	return payload
 }
 
+type ControllerModePayload struct {
+	Mode  string
+	Until *time.Time
+}
+
+func (p ControllerModePayload) GetPayloadHex() string {
+
+	// mode, followed by the until datetime and a flag indicating whether the mode is temporary
+	if p.Until == nil {
+		return fmt.Sprintf("%vFFFFFFFFFFFF00", reverseControllerModeMap[p.Mode])
+	}
+
+	return fmt.Sprintf("%v%v01", reverseControllerModeMap[p.Mode], dateTimeToHex(*p.Until))
+}
+
+type DhwStatePayload struct {
+	Active bool
+	Mode   string
+	Until  *time.Time
+}
+
+func (p DhwStatePayload) GetPayloadHex() string {
+
+	// when following the schedule the state is left to the controller
+	state := "00"
+	if p.Mode == "follow_schedule" {
+		state = "FF"
+	} else if p.Active {
+		state = "01"
+	}
+
+	// zone, state, mode and an unused 3 bytes, followed by the until datetime for temporary overrides
+	payload := fmt.Sprintf("00%v%vFFFFFF", state, reverseDhwModeMap[p.Mode])
+	if p.Mode == "temporary_override" && p.Until != nil {
+		payload += dateTimeToHex(*p.Until)
+	}
+
+	return payload
+}
+
+type SetpointOverridePayload struct {
+	ZoneID   int64
+	Setpoint float64
+	Mode     string
+	Until    *time.Time
+}
+
+func (p SetpointOverridePayload) GetPayloadHex() string {
+
+	// when following the schedule the setpoint is left to the controller
+	setpoint := "7FFF"
+	if p.Mode != "follow_schedule" {
+		setpoint = fmt.Sprintf("%04X", int(math.Round(p.Setpoint*100)))
+	}
+
+	// zone, setpoint in 'centi' degrees celsius, mode and an unused 3 bytes, followed by the until datetime for temporary overrides
+	payload := fmt.Sprintf("%02X%v%vFFFFFF", p.ZoneID, setpoint, reverseZoneModeMap[p.Mode])
+	if p.Mode == "temporary_override" && p.Until != nil {
+		payload += dateTimeToHex(*p.Until)
+	}
+
+	return payload
+}
+
+type DhwSettingsPayload struct {
+	Setpoint     float64
+	Overrun      int
+	Differential float64
+}
+
+func (p DhwSettingsPayload) GetPayloadHex() string {
+
+	// zone, setpoint in 'centi' degrees celsius, overrun in minutes and differential in 'centi' degrees celsius
+	return fmt.Sprintf("00%04X%02X%04X", int(math.Round(p.Setpoint*100)), p.Overrun, int(math.Round(p.Differential*100)))
+}
+
 type Message struct {
 	rawmsg        string
 	messageType   string
@@ -104,6 +269,7 @@ type Message struct {
 	command       string
 	payloadLength int64
 	payload       string
+	receivedAt    time.Time
 }
 
 func (m Message) GetSourceTypeCode() string {
@@ -151,8 +317,58 @@ func (m Message) IsBroadcast() bool {
 }
 
 type State struct {
-	ZoneInfoMap map[int64]ZoneInfo
-	LastUpdated time.Time
+	SchemaVersion  int
+	ControllerID   string
+	ZoneInfoMap    map[int64]ZoneInfo
+	ControllerMode ControllerMode
+	DhwInfo        DhwInfo
+	LastUpdated    time.Time
+}
+
+type ControllerMode struct {
+	Mode      string
+	Until     *time.Time
+	UpdatedAt time.Time
+}
+
+// IsTemporaryMode returns true for modes that can be set until a certain datetime
+func IsTemporaryMode(mode string) bool {
+	switch mode {
+	case "eco", "away", "day_off", "day_off_eco", "custom":
+		return true
+	}
+	return false
+}
+
+type DhwInfo struct {
+	Active       bool
+	Mode         string
+	Until        *time.Time
+	Setpoint     float64
+	Overrun      int
+	Differential float64
+	Temperature  float64
+	UpdatedAt    time.Time
+}
+
+// isDhwInState returns true if dhw is known to be in the state set by the dhw-state flag; on, off, boost or schedule
+func isDhwInState(dhwInfo DhwInfo, state string, until *time.Time, now time.Time) bool {
+
+	switch state {
+	case "on", "off":
+		mode := "permanent_override"
+		if until != nil {
+			mode = "temporary_override"
+		}
+		return dhwInfo.Mode == mode && dhwInfo.Active == (state == "on") && equalTimes(dhwInfo.Until, until)
+	case "boost":
+		// a boost that's still running shouldn't be restarted
+		return dhwInfo.Mode == "temporary_override" && dhwInfo.Active && dhwInfo.Until != nil && dhwInfo.Until.After(now)
+	case "schedule":
+		return dhwInfo.Mode == "follow_schedule"
+	}
+
+	return false
 }
 
 type ZoneInfo struct {
@@ -163,12 +379,72 @@ type ZoneInfo struct {
 	Temperature    float64
 	Setpoint       float64
 	HeatDemand     float64
+	WindowOpen     bool
+	Observations   ZoneObservations
+	LastHeard      time.Time
+	LastPolled     time.Time
+	Stale          bool
 }
 
 func (z ZoneInfo) IsActualZone() bool {
 	return z.ID < 12 && z.Name != ""
 }
 
+// observe records when and from which device the value for a field was received; only values measured in the zone count as hearing from it, since the controller keeps answering polls for settings of a zone whose sensors died
+func (z *ZoneInfo) observe(observation *FieldObservation, source string, receivedAt time.Time) {
+	*observation = FieldObservation{
+		UpdatedAt: receivedAt,
+		Source:    source,
+	}
+
+	switch observation {
+	case &z.Observations.Temperature, &z.Observations.HeatDemand, &z.Observations.Window:
+		if receivedAt.After(z.LastHeard) {
+			z.LastHeard = receivedAt
+		}
+	default:
+		if receivedAt.After(z.LastPolled) {
+			z.LastPolled = receivedAt
+		}
+	}
+}
+
+// withStaleness returns a copy of the zone with values not received within staleAfter marked as stale
+func (z ZoneInfo) withStaleness(now time.Time, staleAfter time.Duration) ZoneInfo {
+	z.Observations.Name.markStale(now, staleAfter)
+	z.Observations.MinTemperature.markStale(now, staleAfter)
+	z.Observations.MaxTemperature.markStale(now, staleAfter)
+	z.Observations.Temperature.markStale(now, staleAfter)
+	z.Observations.Setpoint.markStale(now, staleAfter)
+	z.Observations.HeatDemand.markStale(now, staleAfter)
+	z.Observations.Window.markStale(now, staleAfter)
+	z.Stale = !z.LastHeard.IsZero() && now.Sub(z.LastHeard) > staleAfter
+
+	return z
+}
+
+// ZoneObservations has an observation for each of the zone's received values
+type ZoneObservations struct {
+	Name           FieldObservation
+	MinTemperature FieldObservation
+	MaxTemperature FieldObservation
+	Temperature    FieldObservation
+	Setpoint       FieldObservation
+	HeatDemand     FieldObservation
+	Window         FieldObservation
+}
+
+// FieldObservation has when and from which device a value was last received; values that have never been received are not stale
+type FieldObservation struct {
+	UpdatedAt time.Time
+	Source    string
+	Stale     bool
+}
+
+func (o *FieldObservation) markStale(now time.Time, staleAfter time.Duration) {
+	o.Stale = !o.UpdatedAt.IsZero() && now.Sub(o.UpdatedAt) > staleAfter
+}
+
 type BigQueryZone struct {
 	ZoneID      int64                `bigquery:"zone_id"`
 	ZoneName    string               `bigquery:"zone_name"`
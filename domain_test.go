@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDhwSettingsPayloadGetPayloadHex(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		payload  DhwSettingsPayload
+		expected string
+	}{
+		{"whole degrees", DhwSettingsPayload{Setpoint: 50, Overrun: 0, Differential: 10}, "0013880003E8"},
+		{"differential not exactly representable", DhwSettingsPayload{Setpoint: 57.3, Overrun: 5, Differential: 1.15}, "001662050073"},
+		{"rounds up", DhwSettingsPayload{Setpoint: 55.555, Overrun: 10, Differential: 4.999}, "0015B40A01F4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.payload.GetPayloadHex()
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDefaultPayloadGetPayloadHex(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		payload  DefaultPayload
+		expected string
+	}{
+		{"no values", DefaultPayload{}, "00"},
+		{"single value", DefaultPayload{Values: []int{255}}, "FF"},
+		{"multiple values", DefaultPayload{Values: []int{0, 10, 252}}, "000AFC"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.payload.GetPayloadHex()
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestControllerModePayloadGetPayloadHex(t *testing.T) {
+
+	until := time.Date(2020, 1, 2, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		payload  ControllerModePayload
+		expected string
+	}{
+		{"permanent", ControllerModePayload{Mode: "auto"}, "00FFFFFFFFFFFF00"},
+		{"temporary", ControllerModePayload{Mode: "eco", Until: &until}, "021E0E020107E401"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.payload.GetPayloadHex()
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDhwStatePayloadGetPayloadHex(t *testing.T) {
+
+	until := time.Date(2020, 1, 2, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		payload  DhwStatePayload
+		expected string
+	}{
+		{"follow schedule", DhwStatePayload{Mode: "follow_schedule"}, "00FF00FFFFFF"},
+		{"permanently on", DhwStatePayload{Active: true, Mode: "permanent_override"}, "000102FFFFFF"},
+		{"permanently off", DhwStatePayload{Mode: "permanent_override"}, "000002FFFFFF"},
+		{"temporarily on", DhwStatePayload{Active: true, Mode: "temporary_override", Until: &until}, "000104FFFFFF1E0E020107E4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.payload.GetPayloadHex()
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSetpointOverridePayloadGetPayloadHex(t *testing.T) {
+
+	until := time.Date(2020, 1, 2, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		payload  SetpointOverridePayload
+		expected string
+	}{
+		{"follow schedule", SetpointOverridePayload{ZoneID: 1, Setpoint: 21, Mode: "follow_schedule"}, "017FFF00FFFFFF"},
+		{"permanent", SetpointOverridePayload{ZoneID: 2, Setpoint: 22.5, Mode: "permanent_override"}, "0208CA02FFFFFF"},
+		{"temporary", SetpointOverridePayload{ZoneID: 11, Setpoint: 21.3, Mode: "temporary_override", Until: &until}, "0B085204FFFFFF1E0E020107E4"},
+		{"setpoint not exactly representable", SetpointOverridePayload{ZoneID: 0, Setpoint: 19.99, Mode: "permanent_override"}, "0007CF02FFFFFF"},
+		{"low setpoint not exactly representable", SetpointOverridePayload{ZoneID: 0, Setpoint: 4.35, Mode: "permanent_override"}, "0001B302FFFFFF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := test.payload.GetPayloadHex()
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIsDhwInState(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		dhwInfo  DhwInfo
+		state    string
+		until    *time.Time
+		expected bool
+	}{
+		{"on permanently", DhwInfo{Mode: "permanent_override", Active: true}, "on", nil, true},
+		{"off instead of on", DhwInfo{Mode: "permanent_override", Active: false}, "on", nil, false},
+		{"on until other time", DhwInfo{Mode: "temporary_override", Active: true, Until: &later}, "on", &earlier, false},
+		{"off until same time", DhwInfo{Mode: "temporary_override", Active: false, Until: &later}, "off", &later, true},
+		{"boost running", DhwInfo{Mode: "temporary_override", Active: true, Until: &later}, "boost", nil, true},
+		{"boost ended", DhwInfo{Mode: "temporary_override", Active: true, Until: &earlier}, "boost", nil, false},
+		{"schedule", DhwInfo{Mode: "follow_schedule"}, "schedule", nil, true},
+		{"unknown state", DhwInfo{}, "schedule", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := isDhwInState(test.dhwInfo, test.state, test.until, now)
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestZoneInfoObserve(t *testing.T) {
+
+	receivedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		observation        func(zoneInfo *ZoneInfo) *FieldObservation
+		expectedLastHeard  time.Time
+		expectedLastPolled time.Time
+	}{
+		{"temperature", func(z *ZoneInfo) *FieldObservation { return &z.Observations.Temperature }, receivedAt, time.Time{}},
+		{"heat demand", func(z *ZoneInfo) *FieldObservation { return &z.Observations.HeatDemand }, receivedAt, time.Time{}},
+		{"window", func(z *ZoneInfo) *FieldObservation { return &z.Observations.Window }, receivedAt, time.Time{}},
+		{"name", func(z *ZoneInfo) *FieldObservation { return &z.Observations.Name }, time.Time{}, receivedAt},
+		{"min temperature", func(z *ZoneInfo) *FieldObservation { return &z.Observations.MinTemperature }, time.Time{}, receivedAt},
+		{"setpoint", func(z *ZoneInfo) *FieldObservation { return &z.Observations.Setpoint }, time.Time{}, receivedAt},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zoneInfo := ZoneInfo{ID: 1}
+			observation := test.observation(&zoneInfo)
+			zoneInfo.observe(observation, "01:160371", receivedAt)
+
+			if !observation.UpdatedAt.Equal(receivedAt) || observation.Source != "01:160371" {
+				t.Errorf("expected observation at %v from 01:160371, got %v", receivedAt, observation)
+			}
+			if !zoneInfo.LastHeard.Equal(test.expectedLastHeard) {
+				t.Errorf("expected last heard %v, got %v", test.expectedLastHeard, zoneInfo.LastHeard)
+			}
+			if !zoneInfo.LastPolled.Equal(test.expectedLastPolled) {
+				t.Errorf("expected last polled %v, got %v", test.expectedLastPolled, zoneInfo.LastPolled)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+)
+
+// EventSink is the interface for publishing events derived from decoded messages, like a window being opened or a device going silent
+type EventSink interface {
+	Publish(event Event)
+	Close() error
+	String() string
+}
+
+// Event is a change in the heating system worth acting upon, rather than a measured value
+type Event struct {
+	ID           string                 `json:"id"`
+	Type         string                 `json:"type"`
+	ControllerID string                 `json:"controller_id"`
+	DeviceID     string                 `json:"device_id,omitempty"`
+	DeviceType   string                 `json:"device_type,omitempty"`
+	ZoneID       *int64                 `json:"zone_id,omitempty"`
+	ZoneName     string                 `json:"zone_name,omitempty"`
+	OccurredAt   time.Time              `json:"occurred_at"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+}
+
+const (
+	eventSystemModeChanged = "system_mode_changed"
+	eventWindowOpened      = "window_opened"
+	eventWindowClosed      = "window_closed"
+	eventBatteryLow        = "battery_low"
+	eventDeviceSilent      = "device_silent"
+	eventSetpointOverride  = "setpoint_override"
+	eventOverrideCleared   = "setpoint_override_cleared"
+	eventFaultLogged       = "fault_logged"
+)
+
+var eventTypes = []string{
+	eventSystemModeChanged,
+	eventWindowOpened,
+	eventWindowClosed,
+	eventBatteryLow,
+	eventDeviceSilent,
+	eventSetpointOverride,
+	eventOverrideCleared,
+	eventFaultLogged,
+}
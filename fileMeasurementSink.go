@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	fileMeasurementPrefix    = "measurements-"
+	fileMeasurementStaging   = ".staging"
+	fileMeasurementDayLayout = "2006-01-02"
+)
+
+type fileMeasurementSinkImpl struct {
+	directory     string
+	format        string
+	compression   string
+	retentionDays int
+	csvPaths      map[string]string
+	lastCleanup   string
+	mutex         sync.Mutex
+}
+
+// NewFileMeasurementSink returns a MeasurementSink writing measurements to a file per day in directory, as csv or parquet with the same columns as the BigQuery table; files older than retentionDays get removed, unless it's 0
+func NewFileMeasurementSink(directory, format, compression string, retentionDays int) (MeasurementSink, error) {
+
+	switch format {
+	case "csv":
+		if compression != "none" && compression != "gzip" {
+			return nil, fmt.Errorf("Compression %v isn't supported for csv files", compression)
+		}
+	case "parquet":
+		if compression != "none" && compression != "gzip" && compression != "snappy" {
+			return nil, fmt.Errorf("Compression %v isn't supported for parquet files", compression)
+		}
+	default:
+		return nil, fmt.Errorf("File format %v is not supported", format)
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &fileMeasurementSinkImpl{
+		directory:     directory,
+		format:        format,
+		compression:   compression,
+		retentionDays: retentionDays,
+		csvPaths:      map[string]string{},
+	}, nil
+}
+
+func (fs *fileMeasurementSinkImpl) Write(measurements []Measurement) error {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// measurements are partitioned by the day they were measured, like the bigquery table
+	days := map[string][]Measurement{}
+	for _, measurement := range measurements {
+		day := measurement.MeasuredAt.UTC().Format(fileMeasurementDayLayout)
+		days[day] = append(days[day], measurement)
+	}
+
+	for day, dayMeasurements := range days {
+		var err error
+		if fs.format == "parquet" {
+			err = fs.appendStaging(day, dayMeasurements)
+		} else {
+			err = fs.appendCSV(day, dayMeasurements)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fs.cleanup()
+
+	return nil
+}
+
+// Close converts all staging files into parquet files, including the one of the current day, so no measurements are left in a format other than the one asked for
+func (fs *fileMeasurementSinkImpl) Close() error {
+
+	if fs.format != "parquet" {
+		return nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(fs.directory, fileMeasurementPrefix+"*"+fileMeasurementStaging))
+	if err != nil {
+		return err
+	}
+
+	var convertErr error
+	for _, path := range paths {
+		day := filepath.Base(path)[len(fileMeasurementPrefix):]
+		day = day[:len(day)-len(".parquet"+fileMeasurementStaging)]
+		if err := fs.convertStaging(day); err != nil {
+			log.Warn().Err(err).Msgf("Failed converting %v into a parquet file", path)
+			convertErr = err
+		}
+	}
+
+	return convertErr
+}
+
+func (fs *fileMeasurementSinkImpl) String() string {
+	return fmt.Sprintf("%v files in %v", fs.format, fs.directory)
+}
+
+// appendCSV appends the measurements to the csv file of the day; compressed files get a gzip member per write, which readers treat as a single stream
+func (fs *fileMeasurementSinkImpl) appendCSV(day string, measurements []Measurement) error {
+
+	header := []string{}
+	for _, column := range measurementColumns {
+		header = append(header, column.Name)
+	}
+
+	path, err := fs.csvPath(day, header)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	isNewFile := os.IsNotExist(err)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var output io.Writer = file
+	var gzipWriter *gzip.Writer
+	if fs.compression == "gzip" {
+		gzipWriter = gzip.NewWriter(file)
+		output = gzipWriter
+	}
+
+	csvWriter := csv.NewWriter(output)
+	if isNewFile {
+		csvWriter.Write(header)
+	}
+
+	for _, measurement := range measurements {
+		record := []string{}
+		for _, column := range measurementColumns {
+			record = append(record, toCSVValue(column.Value(measurement)))
+		}
+		csvWriter.Write(record)
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// csvPath returns the csv file of the day with the same header; when the columns changed since the file got started, like after an upgrade, the measurements go into an extra numbered file
+func (fs *fileMeasurementSinkImpl) csvPath(day string, header []string) (string, error) {
+
+	if path, ok := fs.csvPaths[day]; ok {
+		return path, nil
+	}
+
+	extension := ".csv"
+	if fs.compression == "gzip" {
+		extension += ".gz"
+	}
+
+	path := filepath.Join(fs.directory, fileMeasurementPrefix+day+extension)
+	for i := 1; ; i++ {
+		existingHeader, err := readCSVHeader(path, fs.compression == "gzip")
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.Join(existingHeader, ",") == strings.Join(header, ",") {
+			break
+		}
+		path = filepath.Join(fs.directory, fmt.Sprintf("%v%v-%v%v", fileMeasurementPrefix, day, i, extension))
+	}
+
+	// only the file of the current day is written to for long, so the others don't need to be remembered
+	for knownDay := range fs.csvPaths {
+		if knownDay < day {
+			delete(fs.csvPaths, knownDay)
+		}
+	}
+	fs.csvPaths[day] = path
+
+	return path, nil
+}
+
+// readCSVHeader returns the first line of a csv file, or no columns for an empty file
+func readCSVHeader(path string, compressed bool) ([]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var input io.Reader = file
+	if compressed {
+		gzipReader, err := gzip.NewReader(file)
+		if err == io.EOF {
+			return []string{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		input = gzipReader
+	}
+
+	header, err := csv.NewReader(input).Read()
+	if err == io.EOF {
+		return []string{}, nil
+	}
+
+	return header, err
+}
+
+// appendStaging keeps the measurements of a day in a staging file, since a parquet file can't be appended to; it's converted into a parquet file once the day is over
+func (fs *fileMeasurementSinkImpl) appendStaging(day string, measurements []Measurement) error {
+
+	data, err := encodeMeasurements(measurements)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fs.stagingPath(day), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// cleanup converts staging files of past days into parquet files and removes files beyond the retention, once a day
+func (fs *fileMeasurementSinkImpl) cleanup() {
+
+	today := time.Now().UTC().Format(fileMeasurementDayLayout)
+	if fs.lastCleanup == today {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(fs.directory, fileMeasurementPrefix+"*"))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed listing measurement files in %v", fs.directory)
+		return
+	}
+	sort.Strings(paths)
+
+	retainFrom := time.Now().UTC().AddDate(0, 0, -fs.retentionDays).Format(fileMeasurementDayLayout)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if len(name) < len(fileMeasurementPrefix)+len(fileMeasurementDayLayout) {
+			continue
+		}
+		day := name[len(fileMeasurementPrefix) : len(fileMeasurementPrefix)+len(fileMeasurementDayLayout)]
+		if _, err := time.Parse(fileMeasurementDayLayout, day); err != nil {
+			continue
+		}
+
+		if fs.retentionDays > 0 && day < retainFrom {
+			log.Info().Msgf("Removing measurement file %v beyond retention of %v days", path, fs.retentionDays)
+			if err := os.Remove(path); err != nil {
+				log.Warn().Err(err).Msgf("Failed removing measurement file %v", path)
+			}
+			continue
+		}
+
+		if strings.HasSuffix(name, fileMeasurementStaging) && day < today {
+			if err := fs.convertStaging(day); err != nil {
+				log.Warn().Err(err).Msgf("Failed converting %v into a parquet file, retrying tomorrow", path)
+			}
+		}
+	}
+
+	fs.lastCleanup = today
+}
+
+// convertStaging writes the measurements of a staging file into a parquet file; measurements of a day that already has a parquet file, like after a backfill, go into an extra numbered file
+func (fs *fileMeasurementSinkImpl) convertStaging(day string) error {
+
+	stagingPath := fs.stagingPath(day)
+
+	path := filepath.Join(fs.directory, fileMeasurementPrefix+day+".parquet")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(fs.directory, fmt.Sprintf("%v%v-%v.parquet", fileMeasurementPrefix, day, i))
+	}
+
+	// write to a temporary file first, so a failed conversion doesn't leave a broken parquet file behind
+	tempPath := path + ".tmp"
+	err := fs.writeParquet(stagingPath, tempPath)
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	log.Info().Msgf("Converted staging file %v into %v", stagingPath, path)
+
+	return os.Remove(stagingPath)
+}
+
+func (fs *fileMeasurementSinkImpl) writeParquet(stagingPath, path string) error {
+
+	stagingFile, err := os.Open(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer stagingFile.Close()
+
+	parquetFile, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return err
+	}
+	defer parquetFile.Close()
+
+	parquetWriter, err := writer.NewJSONWriter(fs.parquetSchema(), parquetFile, 1)
+	if err != nil {
+		return err
+	}
+	switch fs.compression {
+	case "none":
+		parquetWriter.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	case "gzip":
+		parquetWriter.CompressionType = parquet.CompressionCodec_GZIP
+	case "snappy":
+		parquetWriter.CompressionType = parquet.CompressionCodec_SNAPPY
+	}
+
+	scanner := bufio.NewScanner(stagingFile)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var measurement Measurement
+		if err := json.Unmarshal(scanner.Bytes(), &measurement); err != nil {
+			log.Warn().Err(err).Msgf("Skipping corrupt line in staging file %v", stagingPath)
+			continue
+		}
+
+		record, err := fs.toParquetRecord(measurement)
+		if err != nil {
+			return err
+		}
+		if err := parquetWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return parquetWriter.WriteStop()
+}
+
+func (fs *fileMeasurementSinkImpl) stagingPath(day string) string {
+	return filepath.Join(fs.directory, fileMeasurementPrefix+day+".parquet"+fileMeasurementStaging)
+}
+
+// toParquetRecord returns the measurement as json object for the parquet json writer, with timestamps in microseconds
+func (fs *fileMeasurementSinkImpl) toParquetRecord(measurement Measurement) (string, error) {
+
+	record := map[string]interface{}{}
+	for _, column := range measurementColumns {
+		value := column.Value(measurement)
+		if t, ok := value.(time.Time); ok {
+			value = t.UnixNano() / int64(time.Microsecond)
+		}
+		record[column.Name] = value
+	}
+
+	data, err := json.Marshal(record)
+
+	return string(data), err
+}
+
+// parquetSchema maps the measurement columns onto the schema definition of the parquet json writer
+func (fs *fileMeasurementSinkImpl) parquetSchema() string {
+
+	type parquetField struct {
+		Tag string
+	}
+
+	fields := []parquetField{}
+	for _, column := range measurementColumns {
+		var fieldType string
+		switch column.Type {
+		case columnTypeString:
+			fieldType = "type=UTF8"
+		case columnTypeInteger:
+			fieldType = "type=INT64"
+		case columnTypeFloat:
+			fieldType = "type=DOUBLE"
+		case columnTypeBoolean:
+			fieldType = "type=BOOLEAN"
+		case columnTypeTimestamp:
+			fieldType = "type=TIMESTAMP_MICROS"
+		}
+
+		repetitionType := "OPTIONAL"
+		if column.Required {
+			repetitionType = "REQUIRED"
+		}
+
+		fields = append(fields, parquetField{Tag: fmt.Sprintf("name=%v, %v, repetitiontype=%v", column.Name, fieldType, repetitionType)})
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{
+		"Tag":    "name=measurement, repetitiontype=REQUIRED",
+		"Fields": fields,
+	})
+
+	return string(schema)
+}
+
+// toCSVValue formats a value the way bigquery loads it from csv, with an empty string for null
+func toCSVValue(value interface{}) string {
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.999999Z07:00")
+	}
+
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileMeasurementSinkAppendsCSV(t *testing.T) {
+
+	header := []string{}
+	for _, column := range measurementColumns {
+		header = append(header, column.Name)
+	}
+	currentHeader := strings.Join(header, ",") + "\n"
+
+	tests := []struct {
+		name         string
+		compression  string
+		existing     string
+		expectedPath string
+	}{
+		{"new file", "none", "", "measurements-2019-01-01.csv"},
+		{"file with the same columns", "none", currentHeader, "measurements-2019-01-01.csv"},
+		{"file with other columns", "none", "message_type,value\n", "measurements-2019-01-01-1.csv"},
+		{"compressed file with the same columns", "gzip", currentHeader, "measurements-2019-01-01.csv.gz"},
+		{"compressed file with other columns", "gzip", "message_type,value\n", "measurements-2019-01-01-1.csv.gz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "measurements")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			extension := ".csv"
+			if test.compression == "gzip" {
+				extension += ".gz"
+			}
+			existingPath := filepath.Join(dir, "measurements-2019-01-01"+extension)
+			if test.existing != "" {
+				if err := writeTestFile(existingPath, test.existing, test.compression == "gzip"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sink, err := NewFileMeasurementSink(dir, "csv", test.compression, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// act
+			for _, measurement := range newTestMeasurements(2) {
+				if err := sink.Write([]Measurement{measurement}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sink.Close()
+
+			content, err := readTestFile(filepath.Join(dir, test.expectedPath), test.compression == "gzip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(content), "\n")
+			if len(lines) != 3 || lines[0]+"\n" != currentHeader {
+				t.Errorf("expected the current header and 2 measurements in %v, got %v", test.expectedPath, content)
+			}
+			if test.existing != "" && test.expectedPath != filepath.Base(existingPath) {
+				if content, _ := readTestFile(existingPath, test.compression == "gzip"); content != test.existing {
+					t.Errorf("expected the file with other columns to be left alone, got %v", content)
+				}
+			}
+		})
+	}
+}
+
+func TestFileMeasurementSinkConvertsStagingOnClose(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "measurements")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewFileMeasurementSink(dir, "parquet", "snappy", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC()
+	measurements := newTestMeasurements(3)
+	for i := range measurements {
+		measurements[i].MeasuredAt = today
+	}
+	if err := sink.Write(measurements); err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	day := today.Format(fileMeasurementDayLayout)
+	if fileExists(filepath.Join(dir, "measurements-"+day+".parquet.staging")) {
+		t.Errorf("expected the staging file to be converted")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "measurements-"+day+".parquet")); err != nil || info.Size() == 0 {
+		t.Errorf("expected a parquet file for the current day, got %v", err)
+	}
+}
+
+func TestToCSVValue(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"null", nil, ""},
+		{"string", "Living, room", "Living, room"},
+		{"boolean", true, "true"},
+		{"integer", int64(12), "12"},
+		{"float", 21.35, "21.35"},
+		{"timestamp", time.Date(2019, 1, 1, 12, 0, 0, 123456789, time.FixedZone("CET", 3600)), "2019-01-01T11:00:00.123456Z"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := toCSVValue(test.value); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func writeTestFile(path, content string, compressed bool) error {
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if !compressed {
+		_, err = file.WriteString(content)
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	if _, err := gzipWriter.Write([]byte(content)); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+func readTestFile(path string, compressed bool) (string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if !compressed {
+		data, err := ioutil.ReadAll(file)
+		return string(data), err
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(gzipReader)
+
+	return string(data), err
+}
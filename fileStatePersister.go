@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+type fileStatePersisterImpl struct {
+	path string
+}
+
+// NewFileStatePersister returns a StatePersister storing state in a local json file
+func NewFileStatePersister(path string) StatePersister {
+	return &fileStatePersisterImpl{
+		path: path,
+	}
+}
+
+func (fp *fileStatePersisterImpl) Load() (*State, error) {
+
+	data, err := ioutil.ReadFile(fp.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalState(data), nil
+}
+
+func (fp *fileStatePersisterImpl) Store(state State) error {
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(fp.path, data)
+}
+
+func (fp *fileStatePersisterImpl) String() string {
+	return "file://" + fp.path
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type fileTransportImpl struct {
+	filePath   string
+	file       *os.File
+	lineReader *lineReader
+	offset     int64
+}
+
+// NewFileTransport returns a read-only Transport for a file or named pipe with lines received by a gateway; reopening continues after the last complete line read before, unless the file got truncated in the meantime
+func NewFileTransport(filePath string) Transport {
+	return &fileTransportImpl{
+		filePath: filePath,
+	}
+}
+
+func (ft *fileTransportImpl) Open() error {
+	file, err := os.Open(ft.filePath)
+	if err != nil {
+		return err
+	}
+
+	// the supervisor reopens the file when nothing gets appended for a while, which shouldn't process it all over again
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if ft.offset > 0 && info.Mode().IsRegular() {
+		if info.Size() < ft.offset {
+			log.Info().Msgf("File %v got truncated, reading it from the start", ft.filePath)
+			ft.offset = 0
+		}
+		if _, err := file.Seek(ft.offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	ft.file = file
+	ft.lineReader = newLineReader(bufio.NewReader(file))
+	ft.lineReader.offset = ft.offset
+
+	return nil
+}
+
+func (ft *fileTransportImpl) Close() error {
+	if ft.file == nil {
+		return nil
+	}
+
+	ft.offset = ft.lineReader.offset
+
+	err := ft.file.Close()
+	ft.file = nil
+
+	return err
+}
+
+func (ft *fileTransportImpl) ReadLine() (string, time.Time, error) {
+
+	line, err := ft.lineReader.readLine()
+	if err == io.EOF {
+		// wait for more lines to be appended, like tail -f does
+		time.Sleep(time.Second)
+	}
+
+	return line, time.Now().UTC(), err
+}
+
+func (ft *fileTransportImpl) WriteLine(line string) error {
+	return errors.New("File transport is read-only")
+}
+
+func (ft *fileTransportImpl) String() string {
+	return fmt.Sprintf("file://%v", ft.filePath)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTransportContinuesAfterReopen(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "frames.log")
+
+	tests := []struct {
+		name     string
+		write    func() error
+		expected []string
+	}{
+		{
+			name:     "first open",
+			write:    func() error { return ioutil.WriteFile(filePath, []byte("line 1\nline 2\npartial"), 0644) },
+			expected: []string{"line 1", "line 2"},
+		},
+		{
+			name:     "reopen after appending",
+			write:    func() error { return appendToFile(filePath, " line 3\nline 4\n") },
+			expected: []string{"partial line 3", "line 4"},
+		},
+		{
+			name:     "reopen after truncating",
+			write:    func() error { return ioutil.WriteFile(filePath, []byte("line 5\n"), 0644) },
+			expected: []string{"line 5"},
+		},
+	}
+
+	transport := NewFileTransport(filePath)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.write(); err != nil {
+				t.Fatal(err)
+			}
+			if err := transport.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+
+			lines := []string{}
+			for {
+				line, _, err := transport.ReadLine()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+			}
+
+			if len(lines) != len(test.expected) {
+				t.Fatalf("expected lines %v, got %v", test.expected, lines)
+			}
+			for i := range lines {
+				if lines[i] != test.expected[i] {
+					t.Errorf("expected lines %v, got %v", test.expected, lines)
+				}
+			}
+		})
+	}
+}
+
+func appendToFile(filePath, data string) error {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(data)
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// FrameDeduplicator is the interface for dropping frames that were already received by another gateway
+type FrameDeduplicator interface {
+	IsDuplicate(frame Frame) bool
+}
+
+type receivedFrame struct {
+	gateway    string
+	receivedAt time.Time
+}
+
+type frameDeduplicatorImpl struct {
+	window         time.Duration
+	receivedFrames map[string]receivedFrame
+	lastCleanup    time.Time
+	mutex          sync.Mutex
+}
+
+// NewFrameDeduplicator returns new FrameDeduplicator treating frames from different gateways within window of each other as the same transmission
+func NewFrameDeduplicator(window time.Duration) FrameDeduplicator {
+	return &frameDeduplicatorImpl{
+		window:         window,
+		receivedFrames: map[string]receivedFrame{},
+	}
+}
+
+func (fd *frameDeduplicatorImpl) IsDuplicate(frame Frame) bool {
+
+	// the first 3 characters hold the signal strength, which differs per gateway
+	key := frame.Line
+	if len(key) > 4 {
+		key = key[4:]
+	}
+
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	now := time.Now()
+	fd.cleanup(now)
+
+	// a gateway can receive the same frame repeatedly on its own, which is passed on like before
+	previous, seen := fd.receivedFrames[key]
+	if seen && previous.gateway != frame.Gateway && now.Sub(previous.receivedAt) < fd.window {
+		return true
+	}
+
+	fd.receivedFrames[key] = receivedFrame{
+		gateway:    frame.Gateway,
+		receivedAt: now,
+	}
+
+	return false
+}
+
+func (fd *frameDeduplicatorImpl) cleanup(now time.Time) {
+	if now.Sub(fd.lastCleanup) < fd.window {
+		return
+	}
+
+	for key, receivedFrame := range fd.receivedFrames {
+		if now.Sub(receivedFrame.receivedAt) >= fd.window {
+			delete(fd.receivedFrames, key)
+		}
+	}
+	fd.lastCleanup = now
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FrameProcessor is the interface for filtering received frames and handing the valid ones to the message processor of the controller they belong to, shared by listening, replaying and backfilling
+type FrameProcessor interface {
+	ProcessFrame(frame Frame)
+}
+
+type frameProcessorImpl struct {
+	messageRouter     MessageRouter
+	messageProcessor  MessageProcessor
+	gatewayIdentity   GatewayIdentity
+	frameDeduplicator FrameDeduplicator
+	sendScheduler     SendScheduler
+}
+
+// NewFrameProcessor returns new FrameProcessor; sendScheduler can be nil when no commands are sent
+func NewFrameProcessor(messageRouter MessageRouter, messageProcessor MessageProcessor, gatewayIdentity GatewayIdentity, frameDeduplicator FrameDeduplicator, sendScheduler SendScheduler) FrameProcessor {
+	return &frameProcessorImpl{
+		messageRouter:     messageRouter,
+		messageProcessor:  messageProcessor,
+		gatewayIdentity:   gatewayIdentity,
+		frameDeduplicator: frameDeduplicator,
+		sendScheduler:     sendScheduler,
+	}
+}
+
+func (fp *frameProcessorImpl) ProcessFrame(frame Frame) {
+
+	if fp.frameDeduplicator.IsDuplicate(frame) {
+		framesRejectedTotal.WithLabelValues("duplicate").Inc()
+		log.Debug().Str("_msg", frame.Line).Msgf("Skipping frame from %v already received by another gateway", frame.Gateway)
+		return
+	}
+
+	rawmsg := frame.Line
+
+	if bannerGatewayID, ok := parseGatewayBanner(rawmsg); ok {
+		fp.gatewayIdentity.Learn(bannerGatewayID, "startup banner of "+frame.Gateway)
+	}
+
+	// make sure no obvious errors in getting the data....
+	if len(rawmsg) <= 40 {
+		framesRejectedTotal.WithLabelValues("too_short").Inc()
+		log.Debug().Msgf("unknown: %v", rawmsg)
+		return
+	}
+	if strings.Contains(rawmsg, "_ENC") ||
+		strings.Contains(rawmsg, "_BAD") ||
+		strings.Contains(rawmsg, "BAD") ||
+		strings.Contains(rawmsg, "ERR") {
+		framesRejectedTotal.WithLabelValues("error").Inc()
+		log.Debug().Msgf("unknown: %v", rawmsg)
+		return
+	}
+
+	isValidMessage, err := fp.messageProcessor.IsValidMessage(rawmsg)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("_msg", rawmsg).
+			Msg("Message is not valid")
+	}
+	if !isValidMessage {
+		framesRejectedTotal.WithLabelValues("invalid").Inc()
+		return
+	}
+
+	message := fp.messageProcessor.DecodeMessage(rawmsg, frame.ReceivedAt)
+	if fp.sendScheduler != nil {
+		fp.sendScheduler.ObserveMessage(message)
+	}
+
+	messageProcessor, ok := fp.messageRouter.ProcessorForMessage(message)
+	if !ok {
+		framesRejectedTotal.WithLabelValues("unattributed").Inc()
+		log.Debug().Str("_msg", rawmsg).Msgf("Skipping frame from %v, which isn't known to belong to any of the controllers", message.source)
+		return
+	}
+	messageProcessor.ProcessMessage(message)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameProcessorProcessFrame(t *testing.T) {
+
+	tests := []struct {
+		name                string
+		frames              []Frame
+		expectedTemperature float64
+	}{
+		{
+			name:                "valid frame",
+			frames:              []Frame{{Line: "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0", Gateway: "a"}},
+			expectedTemperature: 20,
+		},
+		{
+			name:   "too short",
+			frames: []Frame{{Line: "045  I --- 01:160371 --:------", Gateway: "a"}},
+		},
+		{
+			name:   "reported by the gateway as corrupt",
+			frames: []Frame{{Line: "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0 * BAD", Gateway: "a"}},
+		},
+		{
+			name:   "not a frame",
+			frames: []Frame{{Line: "# evofw3 0.7.1 with a line long enough to be a frame", Gateway: "a"}},
+		},
+		{
+			name: "same frame from another gateway",
+			frames: []Frame{
+				{Line: "045  I --- 01:160371 --:------ 01:160371 30C9 003 0107D0", Gateway: "a"},
+				{Line: "051  I --- 01:160371 --:------ 01:160371 30C9 003 010834", Gateway: "a"},
+				{Line: "062  I --- 01:160371 --:------ 01:160371 30C9 003 010834", Gateway: "b"},
+			},
+			expectedTemperature: 21,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateStore := NewStateStore("01:160371", time.Hour)
+			requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+			gatewayIdentity := NewGatewayIdentity("")
+			messageProcessor := NewMessageProcessor("01:160371", gatewayIdentity, &collectingMeasurementSink{}, nil, make(chan Command, 10), requestTracker, stateStore)
+			messageRouter := NewMessageRouter([]string{"01:160371"}, map[string]MessageProcessor{"01:160371": messageProcessor})
+			frameProcessor := NewFrameProcessor(messageRouter, messageProcessor, gatewayIdentity, NewFrameDeduplicator(time.Minute), nil)
+
+			for _, frame := range test.frames {
+				frame.ReceivedAt = time.Now().UTC()
+				frameProcessor.ProcessFrame(frame)
+			}
+
+			zoneInfo, _ := stateStore.GetZoneInfo(1)
+			if zoneInfo.Temperature != test.expectedTemperature {
+				t.Errorf("expected temperature %v, got %v", test.expectedTemperature, zoneInfo.Temperature)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GatewayIdentity is the interface for sharing the id of the gateway between the message processors of all controllers, since all commands go out through the same gateway
+type GatewayIdentity interface {
+	GetID() string
+	Learn(gatewayID, reason string)
+}
+
+type gatewayIdentityImpl struct {
+	gatewayID string
+	mutex     sync.RWMutex
+}
+
+// NewGatewayIdentity returns new GatewayIdentity, which learns the id once when it's not configured up front
+func NewGatewayIdentity(gatewayID string) GatewayIdentity {
+	return &gatewayIdentityImpl{
+		gatewayID: gatewayID,
+	}
+}
+
+func (gi *gatewayIdentityImpl) GetID() string {
+
+	gi.mutex.RLock()
+	defer gi.mutex.RUnlock()
+
+	return gi.gatewayID
+}
+
+func (gi *gatewayIdentityImpl) Learn(gatewayID, reason string) {
+
+	gi.mutex.Lock()
+	defer gi.mutex.Unlock()
+
+	if gi.gatewayID != "" {
+		return
+	}
+	gi.gatewayID = gatewayID
+
+	log.Info().Msgf("Learned gateway id %v from %v", gatewayID, reason)
+}
+
+var gatewayBannerRegex = regexp.MustCompile(`\b(18:\d{6})\b`)
+
+// parseGatewayBanner returns the gateway id from the lines a gateway writes when it starts, which start with # or ! instead of the signal strength of a frame
+func parseGatewayBanner(line string) (gatewayID string, ok bool) {
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "!") {
+		return "", false
+	}
+
+	matches := gatewayBannerRegex.FindStringSubmatch(line)
+	if len(matches) < 2 || matches[1] == "18:000730" {
+		return "", false
+	}
+
+	return matches[1], true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseGatewayBanner(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		line       string
+		expectedID string
+		expectedOK bool
+	}{
+		{"comment with id", "# evofw3 0.7.1 18:123456", "18:123456", true},
+		{"status with id", "!V 18:654321", "18:654321", true},
+		{"comment without id", "# evofw3 0.7.1", "", false},
+		{"placeholder id", "# 18:000730", "", false},
+		{"frame", "045  I --- 18:123456 --:------ 18:123456 1F09 003 FF0532", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gatewayID, ok := parseGatewayBanner(test.line)
+			if gatewayID != test.expectedID || ok != test.expectedOK {
+				t.Errorf("expected %v and %v, got %v and %v", test.expectedID, test.expectedOK, gatewayID, ok)
+			}
+		})
+	}
+}
+
+func TestGatewayIdentityLearnsOnce(t *testing.T) {
+
+	gatewayIdentity := NewGatewayIdentity("")
+	gatewayIdentity.Learn("18:123456", "test")
+	gatewayIdentity.Learn("18:654321", "test")
+
+	if gatewayIdentity.GetID() != "18:123456" {
+		t.Errorf("expected 18:123456, got %v", gatewayIdentity.GetID())
+	}
+}
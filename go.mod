@@ -5,15 +5,20 @@ go 1.12
 require (
 	cloud.google.com/go v0.34.0
 	github.com/alecthomas/kingpin v2.2.6+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/ericchiang/k8s v1.2.0
 	github.com/estafette/estafette-foundation v0.0.61
 	github.com/google/martian v2.1.0+incompatible // indirect
 	github.com/googleapis/gax-go v2.0.2+incompatible // indirect
 	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
+	github.com/lib/pq v1.3.0
+	github.com/prometheus/client_golang v0.9.2
 	github.com/rs/zerolog v1.17.2
+	github.com/xitongsys/parquet-go v1.5.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200326031722-42b453e70c3b
 	go.opencensus.io v0.22.0 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
-	google.golang.org/api v0.5.0 // indirect
+	google.golang.org/api v0.5.0
 	google.golang.org/appengine v1.6.1 // indirect
 	google.golang.org/genproto v0.0.0-20190801165951-fa694d86fc64 // indirect
 	google.golang.org/grpc v1.21.1 // indirect
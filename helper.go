@@ -1,7 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -29,3 +36,128 @@ func applyJitterWithPercentage(input, percentage int) (output int) {
 
 	return input - deviation + r.Intn(2*deviation)
 }
+
+// dateTimeToHex encodes a datetime as minutes, hours, day, month and a 2 byte year
+func dateTimeToHex(t time.Time) string {
+
+	return fmt.Sprintf("%02X%02X%02X%02X%04X", t.Minute(), t.Hour(), t.Day(), int(t.Month()), t.Year())
+}
+
+// hexToDateTime decodes a datetime encoded by dateTimeToHex, returning nil if it's not set
+func hexToDateTime(input string) *time.Time {
+
+	if len(input) != 12 || input == "FFFFFFFFFFFF" {
+		return nil
+	}
+
+	minute, _ := strconv.ParseInt(input[0:2], 16, 64)
+	hour, _ := strconv.ParseInt(input[2:4], 16, 64)
+	day, _ := strconv.ParseInt(input[4:6], 16, 64)
+	month, _ := strconv.ParseInt(input[6:8], 16, 64)
+	year, _ := strconv.ParseInt(input[8:12], 16, 64)
+
+	t := time.Date(int(year), time.Month(month), int(day), int(hour), int(minute), 0, 0, time.Local)
+
+	return &t
+}
+
+// hexToDeviceID decodes a device id packed into 3 bytes, with the device type in the first 6 bits and the device number in the other 18 bits
+func hexToDeviceID(input string) string {
+
+	value, _ := strconv.ParseInt(input, 16, 64)
+
+	return fmt.Sprintf("%02d:%06d", value>>18, value&0x3FFFF)
+}
+
+// lookupCode returns the name for a hex code, or the code itself if it's unknown
+func lookupCode(codeMap map[string]string, code string) string {
+
+	if name, ok := codeMap[strings.ToUpper(code)]; ok {
+		return name
+	}
+
+	return code
+}
+
+// splitList returns the trimmed, non-empty values of a comma separated list
+func splitList(input string) (values []string) {
+
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return
+}
+
+// writeFileAtomically replaces the file at path with data, creating its directory if needed
+func writeFileAtomically(path string, data []byte) error {
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first and rename it, so a crash or power cut never leaves a half written file behind
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if err := tempFile.Chmod(0644); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return err
+	}
+
+	// sync the directory as well to make the rename durable
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+
+	return dirFile.Sync()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// equalTimes returns true if both datetimes are unset or set to the same instant
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// equalTemperatures returns true if both temperatures differ less than 0.01 degrees celsius, the resolution temperatures are sent with
+func equalTemperatures(a, b float64) bool {
+	return math.Abs(a-b) < 0.01
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type influxDBMeasurementSinkImpl struct {
+	writeURL   string
+	token      string
+	username   string
+	password   string
+	target     string
+	httpClient *http.Client
+}
+
+// NewInfluxDBMeasurementSink returns a MeasurementSink writing measurements as line protocol to the v1 api of InfluxDB, with database and an optional retention policy, authenticating with username and password if set
+func NewInfluxDBMeasurementSink(serverURL, database, retentionPolicy, username, password string) (MeasurementSink, error) {
+
+	if database == "" {
+		return nil, fmt.Errorf("The influxdb v1 api requires a database")
+	}
+
+	query := url.Values{}
+	query.Set("db", database)
+	if retentionPolicy != "" {
+		query.Set("rp", retentionPolicy)
+	}
+	query.Set("precision", "ns")
+
+	return &influxDBMeasurementSinkImpl{
+		writeURL:   strings.TrimRight(serverURL, "/") + "/write?" + query.Encode(),
+		username:   username,
+		password:   password,
+		target:     fmt.Sprintf("influxdb database %v at %v", database, serverURL),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// NewInfluxDBV2MeasurementSink returns a MeasurementSink writing measurements as line protocol to the v2 api of InfluxDB, into bucket of org, authenticating with token
+func NewInfluxDBV2MeasurementSink(serverURL, org, bucket, token string) (MeasurementSink, error) {
+
+	if org == "" || bucket == "" {
+		return nil, fmt.Errorf("The influxdb v2 api requires an org and bucket")
+	}
+
+	query := url.Values{}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+
+	return &influxDBMeasurementSinkImpl{
+		writeURL:   strings.TrimRight(serverURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:      token,
+		target:     fmt.Sprintf("influxdb bucket %v/%v at %v", org, bucket, serverURL),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (is *influxDBMeasurementSinkImpl) Write(measurements []Measurement) error {
+
+	var body bytes.Buffer
+	for _, measurement := range measurements {
+		body.WriteString(toInfluxDBLine(measurement))
+		body.WriteString("\n")
+	}
+
+	request, err := http.NewRequest(http.MethodPost, is.writeURL, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if is.token != "" {
+		request.Header.Set("Authorization", "Token "+is.token)
+	} else if is.username != "" {
+		request.SetBasicAuth(is.username, is.password)
+	}
+
+	response, err := is.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// both apis respond with 204 No Content once the points are written
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		err := fmt.Errorf("Writing to %v failed with status %v: %v", is.target, response.Status, strings.TrimSpace(string(responseBody)))
+		if isPermanentHTTPStatus(response.StatusCode) {
+			return newPermanentError(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (is *influxDBMeasurementSinkImpl) Close() error {
+	return nil
+}
+
+func (is *influxDBMeasurementSinkImpl) String() string {
+	return is.target
+}
+
+// toInfluxDBLine formats a measurement as line protocol, with the measurement name as influxdb measurement, the zone and source device as tags and a single value field
+func toInfluxDBLine(measurement Measurement) string {
+
+	tags := [][2]string{
+		{"command_type", measurement.CommandType},
+		{"controller_id", measurement.ControllerID},
+		{"device_id", measurement.SourceID},
+		{"device_type", measurement.SourceType},
+		{"message_type", measurement.MessageType},
+	}
+	if measurement.ZoneID != nil {
+		tags = append(tags, [2]string{"zone_id", strconv.FormatInt(*measurement.ZoneID, 10)})
+	}
+	tags = append(tags, [2]string{"zone_name", measurement.ZoneName})
+
+	var line strings.Builder
+	line.WriteString(escapeInfluxDB(measurement.Name, ", "))
+
+	// tags are sorted by key for best performance and empty tags aren't allowed
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		line.WriteString(",")
+		line.WriteString(escapeInfluxDB(tag[0], ",= "))
+		line.WriteString("=")
+		line.WriteString(escapeInfluxDB(tag[1], ",= "))
+	}
+
+	line.WriteString(" value=")
+	line.WriteString(strconv.FormatFloat(measurement.Value, 'f', -1, 64))
+	line.WriteString(" ")
+	line.WriteString(strconv.FormatInt(measurement.MeasuredAt.UnixNano(), 10))
+
+	return line.String()
+}
+
+// escapeInfluxDB escapes the characters that have a special meaning in that part of the line with a backslash
+func escapeInfluxDB(value, characters string) string {
+
+	var escaped strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(characters, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String()
+}
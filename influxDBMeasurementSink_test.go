@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToInfluxDBLine(t *testing.T) {
+
+	measuredAt := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	zoneID := int64(2)
+	firstZoneID := int64(0)
+
+	tests := []struct {
+		name        string
+		measurement Measurement
+		expected    string
+	}{
+		{
+			name:        "zone measurement has all tags",
+			measurement: Measurement{Name: "temperature", Value: 21.35, MessageType: "I", CommandType: "zone_temperature", SourceType: "TRV", SourceID: "04:000001", ControllerID: "01:160371", ZoneID: &zoneID, ZoneName: "Living", MeasuredAt: measuredAt},
+			expected:    "temperature,command_type=zone_temperature,controller_id=01:160371,device_id=04:000001,device_type=TRV,message_type=I,zone_id=2,zone_name=Living value=21.35 1546300800000000000",
+		},
+		{
+			name:        "empty tags are left out",
+			measurement: Measurement{Name: "demand_percentage", Value: 100, SourceType: "CTL", SourceID: "01:160371", MeasuredAt: measuredAt},
+			expected:    "demand_percentage,device_id=01:160371,device_type=CTL value=100 1546300800000000000",
+		},
+		{
+			name:        "first zone keeps its zone id",
+			measurement: Measurement{Name: "setpoint", Value: 5, ZoneID: &firstZoneID, MeasuredAt: measuredAt},
+			expected:    "setpoint,zone_id=0 value=5 1546300800000000000",
+		},
+		{
+			name:        "special characters are escaped",
+			measurement: Measurement{Name: "battery level", Value: 0.5, ZoneID: &zoneID, ZoneName: "Bed room,1=a", MeasuredAt: measuredAt},
+			expected:    `battery\ level,zone_id=2,zone_name=Bed\ room\,1\=a value=0.5 1546300800000000000`,
+		},
+		{
+			name:        "negative value",
+			measurement: Measurement{Name: "temperature", Value: -3.2, MeasuredAt: measuredAt.Add(time.Millisecond)},
+			expected:    "temperature value=-3.2 1546300800001000000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := toInfluxDBLine(test.measurement)
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
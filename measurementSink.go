@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MeasurementSink is the interface for storing measurements decoded from messages
+type MeasurementSink interface {
+	Write(measurements []Measurement) error
+	Close() error
+	String() string
+}
+
+// NewMeasurementSink returns the MeasurementSink with the given name
+func NewMeasurementSink(name string, bigqueryClient BigQueryClient) (MeasurementSink, error) {
+	switch name {
+	case "bigquery":
+		return NewBigQueryMeasurementSink(bigqueryClient, *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	case "influxdb":
+		if *influxDBAPI == "v1" {
+			return NewInfluxDBMeasurementSink(*influxDBURL, *influxDBDatabase, *influxDBRetentionPolicy, *influxDBUsername, *influxDBPassword)
+		}
+		return NewInfluxDBV2MeasurementSink(*influxDBURL, *influxDBOrg, *influxDBBucket, *influxDBToken)
+	case "postgres":
+		return NewPostgresMeasurementSink(*postgresConnectionString, *postgresTable, *postgresHypertable)
+	case "file":
+		return NewFileMeasurementSink(*fileDirectory, *fileFormat, *fileCompression, *fileRetentionDays)
+	}
+
+	return nil, fmt.Errorf("Measurement sink %v is not supported", name)
+}
+
+// measurementColumnType is the type of a column, which each sink maps onto its own types
+type measurementColumnType string
+
+const (
+	columnTypeString    measurementColumnType = "string"
+	columnTypeInteger   measurementColumnType = "integer"
+	columnTypeFloat     measurementColumnType = "float"
+	columnTypeBoolean   measurementColumnType = "boolean"
+	columnTypeTimestamp measurementColumnType = "timestamp"
+)
+
+// measurementColumn is a column of the tables and files measurements are stored in, with the value it gets for a measurement; nil stands for null
+type measurementColumn struct {
+	Name     string
+	Type     measurementColumnType
+	Required bool
+	Value    func(measurement Measurement) interface{}
+}
+
+// measurementColumns are the columns all sinks storing rows share, in the order of the bigquery table; demand, temperature and setpoint keep their own columns, all measurements are in the generic measurement and value columns
+var measurementColumns = []measurementColumn{
+	{"message_type", columnTypeString, true, func(m Measurement) interface{} { return m.MessageType }},
+	{"command_type", columnTypeString, true, func(m Measurement) interface{} { return m.CommandType }},
+	{"source_type", columnTypeString, true, func(m Measurement) interface{} { return m.SourceType }},
+	{"source_id", columnTypeString, true, func(m Measurement) interface{} { return m.SourceID }},
+	{"destination_type", columnTypeString, true, func(m Measurement) interface{} { return m.DestinationType }},
+	{"destination_id", columnTypeString, true, func(m Measurement) interface{} { return m.DestinationID }},
+	{"broadcast", columnTypeBoolean, true, func(m Measurement) interface{} { return m.Broadcast }},
+	{"zone_id", columnTypeInteger, false, func(m Measurement) interface{} {
+		if m.ZoneID == nil {
+			return nil
+		}
+		return *m.ZoneID
+	}},
+	{"zone_name", columnTypeString, false, func(m Measurement) interface{} { return nullIfEmpty(m.ZoneName) }},
+	{"demand_percentage", columnTypeFloat, false, func(m Measurement) interface{} { return valueIfNamed(m, measurementDemandPercentage) }},
+	{"temperature", columnTypeFloat, false, func(m Measurement) interface{} { return valueIfNamed(m, measurementTemperature) }},
+	{"setpoint", columnTypeFloat, false, func(m Measurement) interface{} { return valueIfNamed(m, measurementSetpoint) }},
+	{"inserted_at", columnTypeTimestamp, true, func(m Measurement) interface{} { return m.MeasuredAt }},
+	{"controller_id", columnTypeString, false, func(m Measurement) interface{} { return nullIfEmpty(m.ControllerID) }},
+	{"measurement", columnTypeString, false, func(m Measurement) interface{} { return m.Name }},
+	{"value", columnTypeFloat, false, func(m Measurement) interface{} { return m.Value }},
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func valueIfNamed(measurement Measurement, name string) interface{} {
+	if measurement.Name != name {
+		return nil
+	}
+	return measurement.Value
+}
+
+type fanOutMeasurementSink struct {
+	sinks []MeasurementSink
+}
+
+// NewFanOutMeasurementSink returns a MeasurementSink writing to all sinks, so one failing sink doesn't keep measurements from the others
+func NewFanOutMeasurementSink(sinks []MeasurementSink) MeasurementSink {
+	return &fanOutMeasurementSink{
+		sinks: sinks,
+	}
+}
+
+func (fs *fanOutMeasurementSink) Write(measurements []Measurement) error {
+
+	if len(measurements) == 0 {
+		return nil
+	}
+
+	failedSinks := []string{}
+	for _, sink := range fs.sinks {
+		if err := sink.Write(measurements); err != nil {
+			log.Warn().Err(err).Msgf("Failed writing %v measurements to %v", len(measurements), sink)
+			failedSinks = append(failedSinks, sink.String())
+		}
+	}
+
+	if len(failedSinks) > 0 {
+		return fmt.Errorf("Failed writing measurements to %v", strings.Join(failedSinks, ", "))
+	}
+
+	return nil
+}
+
+func (fs *fanOutMeasurementSink) Close() error {
+
+	var closeErr error
+	for _, sink := range fs.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn().Err(err).Msgf("Failed closing %v", sink)
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+func (fs *fanOutMeasurementSink) String() string {
+
+	names := []string{}
+	for _, sink := range fs.sinks {
+		names = append(names, sink.String())
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// permanentError marks a failure to write measurements that retrying won't resolve, because the sink rejects the measurements themselves
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
+}
+
+// newPermanentError returns err marked as permanent, so the batch gets dead-lettered instead of retried
+func newPermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func isPermanentError(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// isPermanentHTTPStatus returns whether a client error status means the request itself got rejected; timeouts and rate limiting pass when retried later
+func isPermanentHTTPStatus(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 && statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasurementColumns(t *testing.T) {
+
+	measuredAt := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	zoneID := int64(0)
+
+	tests := []struct {
+		name        string
+		measurement Measurement
+		expected    map[string]interface{}
+	}{
+		{
+			name:        "zone temperature",
+			measurement: Measurement{Name: measurementTemperature, Value: 21.5, ControllerID: "01:160371", ZoneID: &zoneID, ZoneName: "Living", MessageType: "I", CommandType: "zone_temperature", SourceType: "CTL", SourceID: "01:160371", DestinationType: "CTL", DestinationID: "01:160371", Broadcast: true, MeasuredAt: measuredAt},
+			expected: map[string]interface{}{
+				"message_type": "I", "command_type": "zone_temperature", "source_type": "CTL", "source_id": "01:160371", "destination_type": "CTL", "destination_id": "01:160371", "broadcast": true,
+				"zone_id": int64(0), "zone_name": "Living", "demand_percentage": nil, "temperature": 21.5, "setpoint": nil,
+				"inserted_at": measuredAt, "controller_id": "01:160371", "measurement": measurementTemperature, "value": 21.5,
+			},
+		},
+		{
+			name:        "measurement without zone or controller",
+			measurement: Measurement{Name: measurementBatteryLevel, Value: 0.5, MessageType: "I", CommandType: "device_battery", SourceType: "TRV", SourceID: "04:000001", DestinationType: "TRV", DestinationID: "04:000001", MeasuredAt: measuredAt},
+			expected: map[string]interface{}{
+				"message_type": "I", "command_type": "device_battery", "source_type": "TRV", "source_id": "04:000001", "destination_type": "TRV", "destination_id": "04:000001", "broadcast": false,
+				"zone_id": nil, "zone_name": nil, "demand_percentage": nil, "temperature": nil, "setpoint": nil,
+				"inserted_at": measuredAt, "controller_id": nil, "measurement": measurementBatteryLevel, "value": 0.5,
+			},
+		},
+		{
+			name:        "demand keeps its own column",
+			measurement: Measurement{Name: measurementDemandPercentage, Value: 100, MeasuredAt: measuredAt},
+			expected: map[string]interface{}{
+				"message_type": "", "command_type": "", "source_type": "", "source_id": "", "destination_type": "", "destination_id": "", "broadcast": false,
+				"zone_id": nil, "zone_name": nil, "demand_percentage": float64(100), "temperature": nil, "setpoint": nil,
+				"inserted_at": measuredAt, "controller_id": nil, "measurement": measurementDemandPercentage, "value": float64(100),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if len(measurementColumns) != len(test.expected) {
+				t.Fatalf("expected %v columns, got %v", len(test.expected), len(measurementColumns))
+			}
+			for _, column := range measurementColumns {
+				actual := column.Value(test.measurement)
+				if actual != test.expected[column.Name] {
+					t.Errorf("expected %v to be %#v, got %#v", column.Name, test.expected[column.Name], actual)
+				}
+			}
+		})
+	}
+}
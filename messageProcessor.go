@@ -3,25 +3,27 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
-	"io"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/rs/zerolog/log"
 )
 
 type MessageProcessor interface {
 	IsValidMessage(rawmsg string) (bool, error)
-	DecodeMessage(rawmsg string) (message Message)
+	DecodeMessage(rawmsg string, receivedAt time.Time) (message Message)
 	ProcessMessage(message Message)
 	ProcessExternalSensorMessage(message Message)
 	ProcessZoneNameMessage(message Message)
 	ProcessScheduleSyncMessage(message Message)
 	ProcessRelayHeatDemandMessage(message Message)
 	ProcessZoneInfoMessage(message Message)
+	ProcessZoneDevicesMessage(message Message)
 	ProcessOtherCommandMessage(message Message)
 	ProcessDeviceInfoMessage(message Message)
 	ProcessBatteryInfoMessage(message Message)
@@ -42,21 +44,68 @@ type MessageProcessor interface {
 	ProcessActuatorCheckReqMessage(message Message)
 	ProcessActuatorStateMessage(message Message)
 	ProcessUnknownMessage(message Message)
-	SendCommand(f io.ReadWriteCloser, command Command)
+	SendCommand(writer LineWriter, command Command)
+	SetControllerMode(mode string, until *time.Time) error
+	SetDhwMode(active bool, until *time.Time) error
+	BoostDhw(duration time.Duration) error
+	ResetDhwMode() error
+	SetDhwSettings(setpoint float64, overrun int, differential float64) error
+	SetZoneSetpoint(zoneID int64, setpoint float64, until *time.Time) error
+	ResetZoneSetpoint(zoneID int64) error
+	CheckSilentDevices(silentAfter time.Duration)
+	KnowsDevice(deviceID string) bool
 }
 
 type messageProcessorImpl struct {
-	controllerID   string
-	bigqueryClient BigQueryClient
-	commandQueue   chan Command
+	controllerID            string
+	measurementSink         MeasurementSink
+	commandQueue            chan Command
+	requestTracker          RequestTracker
+	stateStore              StateStore
+	gatewayIdentity         GatewayIdentity
+	lastSentCommandKey      string // guarded by requestMutex, like the requested settings, since commands are queued from the mqtt goroutine
+	requestedControllerMode *ControllerMode
+	requestedDhwState       *DhwStatePayload
+	requestedDhwSettings    *DhwSettingsPayload
+	eventSink               EventSink
+	deviceLastSeen          map[string]time.Time
+	silentDevices           map[string]bool
+	lowBatteryDevices       map[string]bool
+	openWindows             map[string]bool
+	eventMutex              sync.Mutex
+	devices                 map[string]bool
+	devicesMutex            sync.RWMutex
+	requestMutex            sync.Mutex
 }
 
-func NewMessageProcessor(controllerID string, bigqueryClient BigQueryClient, commandQueue chan Command) MessageProcessor {
-	return &messageProcessorImpl{
-		controllerID:   controllerID,
-		bigqueryClient: bigqueryClient,
-		commandQueue:   commandQueue,
+// NewMessageProcessor returns a MessageProcessor for a controller; eventSink can be nil when no events need to be published
+func NewMessageProcessor(controllerID string, gatewayIdentity GatewayIdentity, measurementSink MeasurementSink, eventSink EventSink, commandQueue chan Command, requestTracker RequestTracker, stateStore StateStore) MessageProcessor {
+	mp := &messageProcessorImpl{
+		controllerID:      controllerID,
+		gatewayIdentity:   gatewayIdentity,
+		measurementSink:   measurementSink,
+		eventSink:         eventSink,
+		commandQueue:      commandQueue,
+		requestTracker:    requestTracker,
+		stateStore:        stateStore,
+		deviceLastSeen:    map[string]time.Time{},
+		silentDevices:     map[string]bool{},
+		lowBatteryDevices: map[string]bool{},
+		openWindows:       map[string]bool{},
+		devices:           map[string]bool{},
 	}
+
+	// devices that sent values for the zones before a restart still belong to the controller, and go silent if they aren't heard from again
+	for _, zoneInfo := range stateStore.GetZoneInfoMap() {
+		for deviceID, lastObservedAt := range lastObservedDevices(zoneInfo.Observations) {
+			mp.addDevice(deviceID)
+			if lastObservedAt.After(mp.deviceLastSeen[deviceID]) {
+				mp.deviceLastSeen[deviceID] = lastObservedAt
+			}
+		}
+	}
+
+	return mp
 }
 
 func (mp *messageProcessorImpl) IsValidMessage(rawmsg string) (bool, error) {
@@ -65,7 +114,7 @@ func (mp *messageProcessorImpl) IsValidMessage(rawmsg string) (bool, error) {
 	return regexp.MatchString(`^\d{3} ( I| W|RQ|RP) --- \d{2}:\d{6} (--:------ |\d{2}:\d{6} ){2}[0-9a-fA-F]{4} \d{3}`, rawmsg)
 }
 
-func (mp *messageProcessorImpl) DecodeMessage(rawmsg string) (message Message) {
+func (mp *messageProcessorImpl) DecodeMessage(rawmsg string, receivedAt time.Time) (message Message) {
 
 	// message type
 	messageType := strings.TrimSpace(rawmsg[4:6])
@@ -97,11 +146,28 @@ func (mp *messageProcessorImpl) DecodeMessage(rawmsg string) (message Message) {
 		command:       command,
 		payloadLength: payloadLength,
 		payload:       payload,
+		receivedAt:    receivedAt,
 	}
 }
 
 func (mp *messageProcessorImpl) ProcessMessage(message Message) {
 
+	if mp.isOwnEcho(message) {
+		log.Debug().
+			Str("_msg", message.rawmsg).
+			Str("gatewayID", mp.gatewayIdentity.GetID()).
+			Msgf("Received echo of %v command", message.GetCommandName())
+		return
+	}
+
+	// the first 3 characters hold the signal strength as seen by the gateway
+	if rssi, err := strconv.ParseFloat(strings.TrimSpace(message.rawmsg[0:3]), 64); err == nil {
+		deviceRSSI.WithLabelValues(message.source).Set(rssi)
+	}
+
+	mp.learnDevices(message)
+	mp.observeDevice(message)
+
 	switch message.GetCommandName() {
 	case "external_sensor":
 		mp.ProcessExternalSensorMessage(message)
@@ -113,6 +179,8 @@ func (mp *messageProcessorImpl) ProcessMessage(message Message) {
 		mp.ProcessRelayHeatDemandMessage(message)
 	case "zone_info":
 		mp.ProcessZoneInfoMessage(message)
+	case "zone_devices":
+		mp.ProcessZoneDevicesMessage(message)
 	case "other_command":
 		mp.ProcessOtherCommandMessage(message)
 	case "device_info":
@@ -154,6 +222,9 @@ func (mp *messageProcessorImpl) ProcessMessage(message Message) {
 	default:
 		mp.ProcessUnknownMessage(message)
 	}
+
+	// match responses to pending requests, unless the response was rejected while processing it
+	mp.requestTracker.Resolve(message)
 }
 
 func (mp *messageProcessorImpl) ProcessExternalSensorMessage(message Message) {
@@ -174,16 +245,10 @@ func (mp *messageProcessorImpl) ProcessZoneNameMessage(message Message) {
 			zoneNameString = strings.TrimSpace(zoneNameString)
 
 			if zoneNameString != "" {
-				zoneInfo, knownZone := zoneInfoMap[zoneID]
-				if knownZone {
+				zoneInfo := mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
 					zoneInfo.Name = zoneNameString
-				} else {
-					zoneInfo = ZoneInfo{
-						ID:   zoneID,
-						Name: zoneNameString,
-					}
-				}
-				zoneInfoMap[zoneID] = zoneInfo
+					zoneInfo.observe(&zoneInfo.Observations.Name, message.source, message.receivedAt)
+				})
 
 				log.Info().
 					Str("_msg", message.rawmsg).
@@ -203,14 +268,7 @@ func (mp *messageProcessorImpl) ProcessZoneNameMessage(message Message) {
 		} else {
 			log.Warn().Err(err).Msgf("Retrieving name for zone %v failed, retrying...", zoneID)
 
-			mp.commandQueue <- Command{
-				messageType:   "RQ",
-				commandName:   "zone_name",
-				destinationID: mp.controllerID,
-				payload: &DefaultPayload{
-					Values: []int{int(zoneID), 0},
-				},
-			}
+			mp.requestTracker.Reject(message)
 		}
 
 		return
@@ -254,19 +312,12 @@ func (mp *messageProcessorImpl) ProcessZoneInfoMessage(message Message) {
 				continue
 			}
 
-			// update zoneinfo if exist
-			zoneInfo, knownZone := zoneInfoMap[zoneID]
-			if knownZone {
+			zoneInfo := mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
 				zoneInfo.MinTemperature = minTemperatureDegrees
 				zoneInfo.MaxTemperature = maxTemperatureDegrees
-			} else {
-				zoneInfo = ZoneInfo{
-					ID:             zoneID,
-					MinTemperature: minTemperatureDegrees,
-					MaxTemperature: maxTemperatureDegrees,
-				}
-			}
-			zoneInfoMap[zoneID] = zoneInfo
+				zoneInfo.observe(&zoneInfo.Observations.MinTemperature, message.source, message.receivedAt)
+				zoneInfo.observe(&zoneInfo.Observations.MaxTemperature, message.source, message.receivedAt)
+			})
 
 			log.Info().
 				Str("_msg", message.rawmsg).
@@ -282,11 +333,41 @@ func (mp *messageProcessorImpl) ProcessZoneInfoMessage(message Message) {
 	mp.ProcessUnknownMessage(message)
 }
 
+func (mp *messageProcessorImpl) ProcessZoneDevicesMessage(message Message) {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType == "RP" && message.payloadLength%6 == 0 {
+		// > RQ --- 18:730 01:160371 --:------ 000C 002 0100
+		// 045 RP --- 01:160371 18:010057 --:------ 000C 012 010000104DB2010001104DB5
+
+		// payload has blocks of 6 bytes, with the zone id in byte 1, the device role in byte 2, the device index in byte 3 and the device id in byte 4 to 6
+		deviceIDs := []string{}
+		for i := 0; i+12 <= len(message.payload); i += 12 {
+			deviceID := hexToDeviceID(message.payload[i+6 : i+12])
+			mp.addDevice(deviceID)
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Strs("devices", deviceIDs).
+			Msg(message.GetCommandName())
+
+		return
+	}
+	mp.ProcessUnknownMessage(message)
+}
+
 func (mp *messageProcessorImpl) ProcessOtherCommandMessage(message Message) {
 	mp.ProcessUnknownMessage(message)
 }
 
 func (mp *messageProcessorImpl) ProcessDeviceInfoMessage(message Message) {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType == "I" && message.payloadLength == 22 && len(message.payload) >= 44 {
+		// 045  I --- 01:160371 --:------ 01:160371 0418 022 000000B0040000000000AA12B2C77FFFFF7000000001
+		mp.processFaultLogEntry(message)
+		return
+	}
 	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType == "RP" && message.payloadLength == 22 {
 		// > RQ --- 18:730 01:160371 --:------ 0418 003 000000
 		// 045 RP --- 01:160371 18:010057 --:------ 0418 022 004000B0040000000000AA12B2C77FFFFF7000000001
@@ -323,11 +404,151 @@ func (mp *messageProcessorImpl) ProcessDeviceInfoMessage(message Message) {
 	mp.ProcessUnknownMessage(message)
 }
 
+// processFaultLogEntry publishes a fault the controller announces to have logged
+func (mp *messageProcessorImpl) processFaultLogEntry(message Message) {
+
+	// payload has the fault state in byte 2, the log index in byte 3, the fault type in byte 5, the zone in byte 6, the device class in byte 7, the timestamp in byte 10 to 15 and the device id in byte 20 to 22
+	payload := strings.ToUpper(message.payload)
+	if payload[18:30] == "00000000007F" {
+		// entry without timestamp, the log is empty
+		return
+	}
+
+	faultState := lookupCode(faultStateMap, payload[2:4])
+	faultType := lookupCode(faultTypeMap, payload[8:10])
+	deviceClass := lookupCode(faultDeviceClassMap, payload[12:14])
+	logIndex, _ := strconv.ParseInt(payload[4:6], 16, 64)
+	domainID, _ := strconv.ParseInt(payload[10:12], 16, 64)
+
+	deviceID := hexToDeviceID(payload[38:44])
+	if deviceID == "00:000000" {
+		deviceID = message.source
+	}
+	mp.addDevice(deviceID)
+
+	log.Info().
+		Str("_msg", message.rawmsg).
+		Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+		Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+		Str("faultState", faultState).
+		Str("faultType", faultType).
+		Str("deviceClass", deviceClass).
+		Str("deviceID", deviceID).
+		Msg("fault_log")
+
+	event := mp.newDeviceEvent(eventFaultLogged, deviceID, message.receivedAt)
+	if domainID < 12 && deviceID != mp.controllerID {
+		zoneInfo, _ := mp.stateStore.GetZoneInfo(domainID)
+		event.ZoneID = &domainID
+		event.ZoneName = zoneInfo.Name
+	}
+	event.Data = map[string]interface{}{
+		"fault_state":  faultState,
+		"fault_type":   faultType,
+		"device_class": deviceClass,
+		"log_index":    logIndex,
+	}
+	mp.publishEvent(event)
+}
+
 func (mp *messageProcessorImpl) ProcessBatteryInfoMessage(message Message) {
+	if message.messageType == "I" && (message.IsBroadcast() || message.destination == mp.controllerID) && message.payloadLength == 3 {
+		// 045  I --- 04:056057 --:------ 04:056057 1060 003 00FF01
+		// 045  I --- 04:056061 --:------ 04:056061 1060 003 002800
+
+		// payload has the battery level in half percentages in byte 2, which is FF when the device doesn't report it, and 00 in byte 3 when the battery is low
+		batteryLevel, _ := strconv.ParseInt(message.payload[2:4], 16, 64)
+		batteryLevelKnown := batteryLevel != 255
+		batteryPercentage := float64(batteryLevel) / 2
+		batteryLow := message.payload[4:6] == "00"
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Bool("batteryLevelKnown", batteryLevelKnown).
+			Float64("batteryPercentage", batteryPercentage).
+			Bool("batteryLow", batteryLow).
+			Msg(message.GetCommandName())
+
+		batteryLowValue := 0.0
+		if batteryLow {
+			batteryLowValue = 1
+		}
+		deviceBatteryLow.WithLabelValues(message.source).Set(batteryLowValue)
+		if batteryLevelKnown {
+			deviceBatteryPercent.WithLabelValues(message.source).Set(batteryPercentage)
+		}
+		measurements := []Measurement{
+			mp.newMeasurement(message, measurementBatteryLow, batteryLowValue),
+		}
+		if batteryLevelKnown {
+			measurements = append(measurements, mp.newMeasurement(message, measurementBatteryLevel, batteryPercentage))
+		}
+		mp.writeMeasurements(measurements...)
+
+		// only raise the alarm when the battery goes from fine to low, not on every report
+		mp.eventMutex.Lock()
+		wasLow := mp.lowBatteryDevices[message.source]
+		mp.lowBatteryDevices[message.source] = batteryLow
+		mp.eventMutex.Unlock()
+
+		if batteryLow && !wasLow {
+			event := mp.newDeviceEvent(eventBatteryLow, message.source, message.receivedAt)
+			if batteryLevelKnown {
+				event.Data = map[string]interface{}{
+					"battery_percentage": batteryPercentage,
+				}
+			}
+			mp.publishEvent(event)
+		}
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
 func (mp *messageProcessorImpl) ProcessDhwSettingsMessage(message Message) {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType != "RQ" && message.messageType != "W" && message.payloadLength == 6 {
+		// > RQ --- 18:730 01:160371 --:------ 10A0 001 00
+		// 045 RP --- 01:160371 18:010057 --:------ 10A0 006 0013880003E8
+
+		// payload has the setpoint in byte 2 and 3, the overrun in byte 4 and the differential in byte 5 and 6
+		setpoint, _ := strconv.ParseInt(message.payload[2:6], 16, 64)
+		overrun, _ := strconv.ParseInt(message.payload[6:8], 16, 64)
+		differential, _ := strconv.ParseInt(message.payload[8:12], 16, 64)
+
+		dhwInfo := mp.stateStore.UpdateDhwInfo(func(dhwInfo *DhwInfo) {
+			dhwInfo.Setpoint = float64(setpoint) / 100
+			dhwInfo.Overrun = int(overrun)
+			dhwInfo.Differential = float64(differential) / 100
+			dhwInfo.UpdatedAt = message.receivedAt
+		})
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Interface("dhwInfo", dhwInfo).
+			Msg(message.GetCommandName())
+
+		mp.writeMeasurements(mp.newMeasurement(message, measurementDhwSetpoint, dhwInfo.Setpoint))
+
+		// check whether requested settings have been applied by the controller
+		mp.requestMutex.Lock()
+		requestedDhwSettings := mp.requestedDhwSettings
+		mp.requestedDhwSettings = nil
+		mp.requestMutex.Unlock()
+		if requestedDhwSettings != nil {
+			if equalTemperatures(requestedDhwSettings.Setpoint, dhwInfo.Setpoint) {
+				log.Info().Msgf("Controller confirmed change to dhw setpoint %v", dhwInfo.Setpoint)
+			} else {
+				log.Warn().Msgf("Controller reports dhw setpoint %v instead of requested setpoint %v", dhwInfo.Setpoint, requestedDhwSettings.Setpoint)
+			}
+		}
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
@@ -340,10 +561,88 @@ func (mp *messageProcessorImpl) ProcessHeartbeatMessage(message Message) {
 }
 
 func (mp *messageProcessorImpl) ProcessDhwTemperatureMessage(message Message) {
+	isFromController := message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID
+	isFromSensor := message.GetSourceTypeName() == "DHW" && (message.IsBroadcast() || message.destination == mp.controllerID)
+	if (isFromController || isFromSensor) && message.messageType != "RQ" && message.payloadLength == 3 {
+		// 045  I --- 07:045960 --:------ 07:045960 1260 003 000911
+		// 045 RP --- 01:160371 18:010057 --:------ 1260 003 000911
+
+		// payload has the temperature in 'centi' degrees celsius in byte 2 and 3
+		temperature, _ := strconv.ParseInt(message.payload[2:6], 16, 64)
+		if temperature == 32767 {
+			// sensor is not available
+			mp.ProcessUnknownMessage(message)
+			return
+		}
+
+		dhwInfo := mp.stateStore.UpdateDhwInfo(func(dhwInfo *DhwInfo) {
+			dhwInfo.Temperature = float64(temperature) / 100
+			dhwInfo.UpdatedAt = message.receivedAt
+		})
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Interface("dhwInfo", dhwInfo).
+			Msg(message.GetCommandName())
+
+		mp.writeMeasurements(mp.newMeasurement(message, measurementDhwTemperature, dhwInfo.Temperature))
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
 func (mp *messageProcessorImpl) ProcessWindowStatusMessage(message Message) {
+	if (message.messageType == "I" || message.messageType == "RP") && ((message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID) || (message.GetSourceTypeName() != "CTL" && (message.IsBroadcast() || message.destination == mp.controllerID))) && message.payloadLength == 3 {
+		// 045  I --- 04:056057 --:------ 04:056057 12B0 003 000000
+		// 045  I --- 04:056057 --:------ 04:056057 12B0 003 00C800
+
+		// payload has the zone id in byte 1 and C8 in byte 2 while a window is open
+		zoneID, _ := strconv.ParseInt(message.payload[0:2], 16, 64)
+		windowOpen := strings.ToUpper(message.payload[2:4]) == "C8"
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Int64("zoneID", zoneID).
+			Bool("windowOpen", windowOpen).
+			Msg(message.GetCommandName())
+
+		// radiator valves don't know their zone, so it's derived from the values they sent
+		var event Event
+		if message.source == mp.controllerID {
+			zoneInfo, _ := mp.stateStore.GetZoneInfo(zoneID)
+			zoneInfo.ID = zoneID
+			if zoneInfo.IsActualZone() {
+				zoneInfo = mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
+					zoneInfo.WindowOpen = windowOpen
+					zoneInfo.observe(&zoneInfo.Observations.Window, message.source, message.receivedAt)
+				})
+			}
+			event = mp.newZoneEvent("", message, zoneInfo)
+		} else {
+			event = mp.newDeviceEvent("", message.source, message.receivedAt)
+		}
+
+		windowKey := fmt.Sprintf("%v/%v", message.source, zoneID)
+		mp.eventMutex.Lock()
+		wasOpen := mp.openWindows[windowKey]
+		mp.openWindows[windowKey] = windowOpen
+		mp.eventMutex.Unlock()
+
+		if windowOpen && !wasOpen {
+			event.Type = eventWindowOpened
+			mp.publishEvent(event)
+		} else if !windowOpen && wasOpen {
+			event.Type = eventWindowClosed
+			mp.publishEvent(event)
+		}
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
@@ -352,6 +651,58 @@ func (mp *messageProcessorImpl) ProcessSyncMessage(message Message) {
 }
 
 func (mp *messageProcessorImpl) ProcessDhwStateMessage(message Message) {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType != "RQ" && message.messageType != "W" && (message.payloadLength == 6 || message.payloadLength == 12) {
+		// > RQ --- 18:730 01:160371 --:------ 1F41 001 00
+		// 045 RP --- 01:160371 18:010057 --:------ 1F41 006 000100FFFFFF
+		// 045  I --- 01:160371 --:------ 01:160371 1F41 012 000104FFFFFF2D0F120A07EA
+
+		// payload has the state in byte 2, the mode in byte 3 and the until datetime in byte 7 to 12 for temporary overrides
+		modeCode := strings.ToUpper(message.payload[4:6])
+		mode, knownMode := dhwModeMap[modeCode]
+		if !knownMode {
+			log.Warn().
+				Str("_msg", message.rawmsg).
+				Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+				Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+				Str("commandType", message.GetCommandName()).
+				Msgf("Dhw mode %v is unknown, not processing...", modeCode)
+			return
+		}
+
+		var until *time.Time
+		if message.payloadLength == 12 {
+			until = hexToDateTime(strings.ToUpper(message.payload[12:24]))
+		}
+
+		dhwInfo := mp.stateStore.UpdateDhwInfo(func(dhwInfo *DhwInfo) {
+			dhwInfo.Active = message.payload[2:4] == "01"
+			dhwInfo.Mode = mode
+			dhwInfo.Until = until
+			dhwInfo.UpdatedAt = message.receivedAt
+		})
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Interface("dhwInfo", dhwInfo).
+			Msg(message.GetCommandName())
+
+		// check whether a requested state change has been applied by the controller
+		mp.requestMutex.Lock()
+		requestedDhwState := mp.requestedDhwState
+		mp.requestedDhwState = nil
+		mp.requestMutex.Unlock()
+		if requestedDhwState != nil {
+			if requestedDhwState.Mode == dhwInfo.Mode && (dhwInfo.Mode == "follow_schedule" || requestedDhwState.Active == dhwInfo.Active) {
+				log.Info().Msgf("Controller confirmed change to dhw mode %v", dhwInfo.Mode)
+			} else {
+				log.Warn().Msgf("Controller reports dhw mode %v instead of requested mode %v", dhwInfo.Mode, requestedDhwState.Mode)
+			}
+		}
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
@@ -368,6 +719,7 @@ func (mp *messageProcessorImpl) ProcessSetpointMessage(message Message) {
 	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType != "RQ" && message.payloadLength%3 == 0 {
 		// 045  I --- 01:160371 --:------ 01:160371 2309 018 00079E0105DC02076C0306A405076C0605DC
 
+		measurements := []Measurement{}
 		for i := 0; i < int(2*message.payloadLength); i += 6 {
 
 			// payload has blocks of 3 bytes, with zone id in byte 1 and temperature in 'centi' degrees celsius in byte 2 and 3
@@ -384,27 +736,26 @@ func (mp *messageProcessorImpl) ProcessSetpointMessage(message Message) {
 					Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
 					Str("commandType", message.GetCommandName()).
 					Msgf("Zone setpoint %v is too high, not processing...", setpointDegrees)
+
+				continue
 			}
 
-			// update zoneinfo if exist
-			zoneInfo, knownZone := zoneInfoMap[zoneID]
-			if knownZone {
+			setpointAccepted := false
+			zoneInfo := mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
 				// check if min and max temp are already known
 				if zoneInfo.MinTemperature != 0 && zoneInfo.MaxTemperature != 0 {
 					// check if the setpoint isn't outside of the min and max temperature range
 					if setpointDegrees > zoneInfo.MinTemperature && setpointDegrees < zoneInfo.MaxTemperature {
 						zoneInfo.Setpoint = setpointDegrees
+						zoneInfo.observe(&zoneInfo.Observations.Setpoint, message.source, message.receivedAt)
+						setpointAccepted = true
 					}
 				} else {
 					zoneInfo.Setpoint = setpointDegrees
+					zoneInfo.observe(&zoneInfo.Observations.Setpoint, message.source, message.receivedAt)
+					setpointAccepted = true
 				}
-			} else {
-				zoneInfo = ZoneInfo{
-					ID:       zoneID,
-					Setpoint: setpointDegrees,
-				}
-			}
-			zoneInfoMap[zoneID] = zoneInfo
+			})
 
 			log.Info().
 				Str("_msg", message.rawmsg).
@@ -412,8 +763,15 @@ func (mp *messageProcessorImpl) ProcessSetpointMessage(message Message) {
 				Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
 				Interface("zoneInfo", zoneInfo).
 				Msg(message.GetCommandName())
+
+			// only record setpoints for named zones, like heat demand
+			if setpointAccepted && setpointDegrees <= 100 && zoneInfo.IsActualZone() {
+				measurements = append(measurements, mp.newZoneMeasurement(message, measurementSetpoint, setpointDegrees, zoneInfo))
+			}
 		}
 
+		mp.writeMeasurements(measurements...)
+
 		return
 	}
 
@@ -421,17 +779,134 @@ func (mp *messageProcessorImpl) ProcessSetpointMessage(message Message) {
 }
 
 func (mp *messageProcessorImpl) ProcessSetpointOverrideMessage(message Message) {
-	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType == "RP" {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && (message.messageType == "I" || message.messageType == "RP") && (message.payloadLength == 7 || message.payloadLength == 13) {
 		// > RQ --- 18:730 01:160371 --:------ 2349 001 00
 		// 045 RP --- 01:160371 18:010057 --:------ 2349 007 00079E00FFFFFF
+		// 045  I --- 01:160371 --:------ 01:160371 2349 013 0107D004FFFFFF2D0F120A07EA
+
+		// payload has the zone id in byte 1, the setpoint in byte 2 and 3, the mode in byte 4 and the until datetime in byte 8 to 13 for temporary overrides
+		zoneID, _ := strconv.ParseInt(message.payload[0:2], 16, 64)
+		modeCode := strings.ToUpper(message.payload[6:8])
+		mode, knownMode := zoneModeMap[modeCode]
+		if !knownMode {
+			log.Warn().
+				Str("_msg", message.rawmsg).
+				Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+				Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+				Str("commandType", message.GetCommandName()).
+				Msgf("Zone mode %v is unknown, not processing...", modeCode)
+			return
+		}
+
+		var until *time.Time
+		if message.payloadLength == 13 {
+			until = hexToDateTime(strings.ToUpper(message.payload[14:26]))
+		}
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Int64("zoneID", zoneID).
+			Str("mode", mode).
+			Msg(message.GetCommandName())
+
+		// the controller announces overrides with an I, while a response only tells the current mode when asked for it
+		if message.messageType == "I" {
+			zoneInfo, _ := mp.stateStore.GetZoneInfo(zoneID)
+			zoneInfo.ID = zoneID
+
+			eventType := eventSetpointOverride
+			if mode == "follow_schedule" {
+				eventType = eventOverrideCleared
+			}
+
+			event := mp.newZoneEvent(eventType, message, zoneInfo)
+			event.Data = map[string]interface{}{
+				"mode": mode,
+			}
+			if setpoint := strings.ToUpper(message.payload[2:6]); setpoint != "7FFF" {
+				setpointValue, _ := strconv.ParseInt(setpoint, 16, 64)
+				event.Data["setpoint"] = float64(setpointValue) / 100
+			}
+			if until != nil {
+				event.Data["until"] = until
+			}
+			mp.publishEvent(event)
+		}
+
+		return
 	}
 	mp.ProcessUnknownMessage(message)
 }
 
 func (mp *messageProcessorImpl) ProcessControllerModeMessage(message Message) {
-	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType == "RP" {
+	if message.GetSourceTypeName() == "CTL" && message.source == mp.controllerID && message.messageType != "RQ" && message.messageType != "W" && message.payloadLength == 8 {
 		// > RQ --- 18:730 01:160371 --:------ 2E04 001 FF
 		// 045 RP --- 01:160371 18:010057 --:------ 2E04 008 00FFFFFFFFFFFF00
+		// > W --- 18:730 01:160371 --:------ 2E04 008 0300100C0A07EA01
+		// 045  I --- 01:160371 --:------ 01:160371 2E04 008 0300100C0A07EA01
+
+		// payload has the mode in byte 1, the until datetime in byte 2 to 7 and a temporary flag in byte 8
+		modeCode := strings.ToUpper(message.payload[0:2])
+		mode, knownMode := controllerModeMap[modeCode]
+		if !knownMode {
+			log.Warn().
+				Str("_msg", message.rawmsg).
+				Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+				Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+				Str("commandType", message.GetCommandName()).
+				Msgf("Controller mode %v is unknown, not processing...", modeCode)
+			return
+		}
+
+		var until *time.Time
+		if message.payload[14:16] == "01" {
+			until = hexToDateTime(strings.ToUpper(message.payload[2:14]))
+		}
+
+		controllerMode := ControllerMode{
+			Mode:      mode,
+			Until:     until,
+			UpdatedAt: message.receivedAt,
+		}
+		previousControllerMode := mp.stateStore.GetControllerMode()
+		mp.stateStore.SetControllerMode(controllerMode)
+
+		// the mode isn't known before the first response after a fresh start, so that's not a change
+		if previousControllerMode.Mode != "" && previousControllerMode.Mode != mode {
+			event := mp.newDeviceEvent(eventSystemModeChanged, message.source, message.receivedAt)
+			event.Data = map[string]interface{}{
+				"mode":          mode,
+				"previous_mode": previousControllerMode.Mode,
+			}
+			if until != nil {
+				event.Data["until"] = until
+			}
+			mp.publishEvent(event)
+		}
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Interface("controllerMode", controllerMode).
+			Msg(message.GetCommandName())
+
+		// check whether a requested mode change has been applied by the controller
+		mp.requestMutex.Lock()
+		requestedControllerMode := mp.requestedControllerMode
+		mp.requestedControllerMode = nil
+		mp.requestMutex.Unlock()
+		if requestedControllerMode != nil {
+			if requestedControllerMode.Mode == mode {
+				log.Info().Msgf("Controller confirmed change to mode %v", mode)
+			} else {
+				log.Warn().Msgf("Controller reports mode %v instead of requested mode %v", mode, requestedControllerMode.Mode)
+			}
+		}
+
+		return
 	}
 	mp.ProcessUnknownMessage(message)
 }
@@ -442,6 +917,7 @@ func (mp *messageProcessorImpl) ProcessZoneTemperatureMessage(message Message) {
 		// 045 RP --- 01:160371 18:010057 --:------ 30C9 003 000824 (single zone)
 		// 045  I --- 01:160371 --:------ 01:160371 30C9 018 00081A0107BF0207CA03082005086B060884 (all zones)
 
+		measurements := []Measurement{}
 		for i := 0; i < int(2*message.payloadLength); i += 6 {
 
 			// payload has blocks of 3 bytes, with zone id in byte 1 and temperature in 'centi' degrees celsius in byte 2 and 3
@@ -458,19 +934,14 @@ func (mp *messageProcessorImpl) ProcessZoneTemperatureMessage(message Message) {
 					Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
 					Str("commandType", message.GetCommandName()).
 					Msgf("Zone temperature %v is too high, not processing...", temperatureDegrees)
+
+				continue
 			}
 
-			// update zoneinfo if exist
-			zoneInfo, knownZone := zoneInfoMap[zoneID]
-			if knownZone {
+			zoneInfo := mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
 				zoneInfo.Temperature = temperatureDegrees
-			} else {
-				zoneInfo = ZoneInfo{
-					ID:          zoneID,
-					Temperature: temperatureDegrees,
-				}
-			}
-			zoneInfoMap[zoneID] = zoneInfo
+				zoneInfo.observe(&zoneInfo.Observations.Temperature, message.source, message.receivedAt)
+			})
 
 			log.Info().
 				Str("_msg", message.rawmsg).
@@ -478,8 +949,15 @@ func (mp *messageProcessorImpl) ProcessZoneTemperatureMessage(message Message) {
 				Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
 				Interface("zoneInfo", zoneInfo).
 				Msg(message.GetCommandName())
+
+			// only record temperatures for named zones, like heat demand
+			if temperatureDegrees <= 100 && zoneInfo.IsActualZone() {
+				measurements = append(measurements, mp.newZoneMeasurement(message, measurementTemperature, temperatureDegrees, zoneInfo))
+			}
 		}
 
+		mp.writeMeasurements(measurements...)
+
 		return
 	}
 	mp.ProcessUnknownMessage(message)
@@ -498,6 +976,29 @@ func (mp *messageProcessorImpl) ProcessActuatorCheckReqMessage(message Message)
 }
 
 func (mp *messageProcessorImpl) ProcessActuatorStateMessage(message Message) {
+	isFromActuator := message.GetSourceTypeName() == "OTB" || message.GetSourceTypeName() == "BDR"
+	if isFromActuator && (message.IsBroadcast() || message.destination == mp.controllerID) && message.messageType != "RQ" && message.payloadLength >= 3 {
+		// 045 RP --- 10:048122 01:160371 --:------ 3EF0 003 006410
+		// 045  I --- 13:237335 --:------ 13:237335 3EF0 003 00C8FF
+
+		// payload has the modulation level in percent in byte 2, which is FF when it's not reported
+		modulation, _ := strconv.ParseInt(message.payload[2:4], 16, 64)
+		if modulation > 100 {
+			mp.ProcessUnknownMessage(message)
+			return
+		}
+
+		log.Info().
+			Str("_msg", message.rawmsg).
+			Str("source", fmt.Sprintf("%v:%v", message.GetSourceTypeName(), message.GetSourceID())).
+			Str("target", fmt.Sprintf("%v:%v", message.GetDestinationTypeName(), message.GetDestinationID())).
+			Int64("modulation", modulation).
+			Msg(message.GetCommandName())
+
+		boilerModulationPercent.WithLabelValues(mp.controllerID, message.source).Set(float64(modulation))
+
+		return
+	}
 	mp.ProcessUnknownMessage(message)
 }
 
@@ -528,18 +1029,10 @@ func (mp *messageProcessorImpl) processHeatDemandMessage(message Message) {
 		demand, _ := strconv.ParseInt(message.payload[2:4], 16, 64)
 		demandPercentage := float64(demand) / 200 * 100
 
-		// update zoneinfo if exist
-		zoneInfo, knownZone := zoneInfoMap[zoneID]
-		if knownZone {
+		zoneInfo := mp.stateStore.UpdateZoneInfo(zoneID, func(zoneInfo *ZoneInfo) {
 			zoneInfo.HeatDemand = demandPercentage
-			zoneInfoMap[zoneID] = zoneInfo
-		} else {
-			zoneInfo = ZoneInfo{
-				ID:         zoneID,
-				HeatDemand: demandPercentage,
-			}
-		}
-		zoneInfoMap[zoneID] = zoneInfo
+			zoneInfo.observe(&zoneInfo.Observations.HeatDemand, message.source, message.receivedAt)
+		})
 
 		log.Info().
 			Str("_msg", message.rawmsg).
@@ -549,40 +1042,214 @@ func (mp *messageProcessorImpl) processHeatDemandMessage(message Message) {
 			Msg(message.GetCommandName())
 
 		if zoneID >= 12 || zoneInfo.Name != "" {
-			measurements := []BigQueryMeasurement{
-				BigQueryMeasurement{
-					MessageType:      message.messageType,
-					CommandType:      message.GetCommandName(),
-					SourceType:       message.GetSourceTypeName(),
-					SourceID:         message.GetSourceID(),
-					DestinationType:  message.GetDestinationTypeName(),
-					DestinationID:    message.GetDestinationID(),
-					Broadcast:        message.IsBroadcast(),
-					ZoneID:           bigquery.NullInt64{Int64: zoneID, Valid: true},
-					ZoneName:         bigquery.NullString{StringVal: zoneInfo.Name, Valid: knownZone && zoneInfo.Name != ""},
-					DemandPercentage: bigquery.NullFloat64{Float64: demandPercentage, Valid: true},
-					Temperature:      bigquery.NullFloat64{Valid: false},
-					Setpoint:         bigquery.NullFloat64{Valid: false},
-					InsertedAt:       time.Now().UTC(),
-				},
-			}
+			mp.writeMeasurements(mp.newZoneMeasurement(message, measurementDemandPercentage, demandPercentage, zoneInfo))
+		}
+
+		return
+	}
+	mp.ProcessUnknownMessage(message)
+}
+
+// newMeasurement returns a measurement with the details of the message it was decoded from
+func (mp *messageProcessorImpl) newMeasurement(message Message, name string, value float64) Measurement {
+	return Measurement{
+		Name:            name,
+		Value:           value,
+		ControllerID:    mp.controllerID,
+		MessageType:     message.messageType,
+		CommandType:     message.GetCommandName(),
+		SourceType:      message.GetSourceTypeName(),
+		SourceID:        message.GetSourceID(),
+		DestinationType: message.GetDestinationTypeName(),
+		DestinationID:   message.GetDestinationID(),
+		Broadcast:       message.IsBroadcast(),
+		MeasuredAt:      message.receivedAt,
+	}
+}
+
+// newZoneMeasurement returns a measurement for a zone, including the zone's name once it's known
+func (mp *messageProcessorImpl) newZoneMeasurement(message Message, name string, value float64, zoneInfo ZoneInfo) Measurement {
+	measurement := mp.newMeasurement(message, name, value)
+	zoneID := zoneInfo.ID
+	measurement.ZoneID = &zoneID
+	measurement.ZoneName = zoneInfo.Name
+
+	return measurement
+}
+
+func (mp *messageProcessorImpl) writeMeasurements(measurements ...Measurement) {
+	err := mp.measurementSink.Write(measurements)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed writing measurements to %v", mp.measurementSink)
+	}
+}
+
+// learnDevices remembers the devices exchanging messages with the controller, so their broadcasts can be told apart from those of a neighbouring system
+func (mp *messageProcessorImpl) learnDevices(message Message) {
+
+	if message.source == mp.controllerID && message.destination != mp.controllerID {
+		mp.addDevice(message.destination)
+	}
+	if message.destination == mp.controllerID && message.source != mp.controllerID {
+		mp.addDevice(message.source)
+	}
+}
+
+func (mp *messageProcessorImpl) addDevice(deviceID string) {
+
+	if len(deviceID) != 9 || deviceID == "--:------" || deviceID == "00:000000" {
+		return
+	}
+
+	// gateways and controllers exchange messages with every system they hear
+	switch deviceTypeMap[deviceID[0:2]] {
+	case "DGW", "CTL":
+		return
+	}
+
+	mp.devicesMutex.Lock()
+	defer mp.devicesMutex.Unlock()
+
+	mp.devices[deviceID] = true
+}
+
+// KnowsDevice returns true if the device has exchanged messages with the controller or is listed as one of its devices
+func (mp *messageProcessorImpl) KnowsDevice(deviceID string) bool {
+
+	mp.devicesMutex.RLock()
+	defer mp.devicesMutex.RUnlock()
+
+	return mp.devices[deviceID]
+}
+
+// observeDevice keeps track of when the devices of the controller were last heard from, to tell when they go silent
+func (mp *messageProcessorImpl) observeDevice(message Message) {
+
+	// gateways and devices of neighbouring systems aren't ours to watch
+	if message.GetSourceTypeName() == "DGW" ||
+		(message.GetSourceTypeName() == "CTL" && message.source != mp.controllerID) ||
+		(message.GetDestinationTypeName() == "CTL" && message.destination != mp.controllerID) {
+		return
+	}
+
+	mp.eventMutex.Lock()
+	defer mp.eventMutex.Unlock()
+
+	mp.deviceLastSeen[message.source] = message.receivedAt
+	delete(mp.silentDevices, message.source)
+}
+
+// CheckSilentDevices publishes an event for every device that hasn't been heard from for longer than silentAfter, once until it's heard from again
+func (mp *messageProcessorImpl) CheckSilentDevices(silentAfter time.Duration) {
+
+	now := time.Now().UTC()
+
+	events := []Event{}
+	mp.eventMutex.Lock()
+	for deviceID, lastSeen := range mp.deviceLastSeen {
+		if mp.silentDevices[deviceID] || now.Sub(lastSeen) < silentAfter {
+			continue
+		}
+		mp.silentDevices[deviceID] = true
+
+		log.Warn().Msgf("Device %v of controller %v hasn't been heard from since %v", deviceID, mp.controllerID, lastSeen)
 
-			err := mp.bigqueryClient.InsertMeasurements(*bigqueryDataset, *bigqueryTable, measurements)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed inserting measurements into bigquery table")
+		event := mp.newDeviceEvent(eventDeviceSilent, deviceID, now)
+		event.Data = map[string]interface{}{
+			"last_seen_at":       lastSeen,
+			"silent_for_seconds": int64(now.Sub(lastSeen).Seconds()),
+		}
+		events = append(events, event)
+	}
+	mp.eventMutex.Unlock()
+
+	for _, event := range events {
+		mp.publishEvent(event)
+	}
+}
+
+// newDeviceEvent returns an event for a device, in the zone the device sent values for if any
+func (mp *messageProcessorImpl) newDeviceEvent(eventType, deviceID string, occurredAt time.Time) Event {
+
+	deviceType := deviceTypeMap[deviceID[0:2]]
+	if deviceType == "" {
+		deviceType = "NA"
+	}
+
+	event := Event{
+		Type:         eventType,
+		ControllerID: mp.controllerID,
+		DeviceID:     deviceID,
+		DeviceType:   deviceType,
+		OccurredAt:   occurredAt,
+	}
+
+	// the controller sends values for all zones, so it doesn't belong to any of them
+	if deviceID == mp.controllerID {
+		return event
+	}
+
+	zoneInfoMap := mp.stateStore.GetZoneInfoMap()
+	zoneIDs := []int64{}
+	for zoneID := range zoneInfoMap {
+		zoneIDs = append(zoneIDs, zoneID)
+	}
+	sort.Slice(zoneIDs, func(i, j int) bool { return zoneIDs[i] < zoneIDs[j] })
+
+	for _, zoneID := range zoneIDs {
+		zoneInfo := zoneInfoMap[zoneID]
+		if !zoneInfo.IsActualZone() {
+			continue
+		}
+		for _, observedDeviceID := range observedDevices(zoneInfo.Observations) {
+			if observedDeviceID == deviceID {
+				event.ZoneID = &zoneInfo.ID
+				event.ZoneName = zoneInfo.Name
+				return event
 			}
 		}
+	}
+
+	return event
+}
+
+// newZoneEvent returns an event for a zone, sent by the device of the message
+func (mp *messageProcessorImpl) newZoneEvent(eventType string, message Message, zoneInfo ZoneInfo) Event {
+
+	zoneID := zoneInfo.ID
+
+	return Event{
+		Type:         eventType,
+		ControllerID: mp.controllerID,
+		DeviceID:     message.source,
+		DeviceType:   message.GetSourceTypeName(),
+		ZoneID:       &zoneID,
+		ZoneName:     zoneInfo.Name,
+		OccurredAt:   message.receivedAt,
+	}
+}
 
+func (mp *messageProcessorImpl) publishEvent(event Event) {
+
+	if mp.eventSink == nil {
 		return
 	}
-	mp.ProcessUnknownMessage(message)
+
+	log.Info().Interface("event", event).Msgf("Publishing %v event to %v", event.Type, mp.eventSink)
+
+	mp.eventSink.Publish(event)
 }
 
-func (mp *messageProcessorImpl) SendCommand(f io.ReadWriteCloser, command Command) {
+func (mp *messageProcessorImpl) SendCommand(writer LineWriter, command Command) {
 
 	messageType := command.messageType
 	commandCode := reverseCommandsMap[command.commandName]
+
+	// until the gateway id is known use the placeholder id the gateway replaces with its own
 	source := "18:730"
+	if gatewayID := mp.gatewayIdentity.GetID(); gatewayID != "" {
+		source = gatewayID
+	}
 	destination := command.destinationID
 	if command.broadcast {
 		destination = source
@@ -596,18 +1263,291 @@ func (mp *messageProcessorImpl) SendCommand(f io.ReadWriteCloser, command Comman
 	payload := command.payload.GetPayloadHex()
 	payloadLength := len(payload) / 2
 
-	commandString := fmt.Sprintf("%v --- %v %v --:------ %v %03d %v", messageType, source, destination, commandCode, payloadLength, payload)
+	commandString := fmt.Sprintf("%2v --- %v %v --:------ %v %03d %v", messageType, source, destination, commandCode, payloadLength, payload)
 	if command.broadcast {
-		commandString = fmt.Sprintf("%v --- %v --:------ %v %v %03d %v", messageType, source, destination, commandCode, payloadLength, payload)
+		commandString = fmt.Sprintf("%2v --- %v --:------ %v %v %03d %v", messageType, source, destination, commandCode, payloadLength, payload)
 	}
 
 	log.Info().Str("_msg", commandString).Msgf("> %v", command.commandName)
 
-	_, err := f.Write([]byte(commandString + "\r\n"))
+	err := writer.WriteLine(commandString)
 	if err != nil {
+		commandsSentTotal.WithLabelValues(command.commandName, "failed").Inc()
 		log.Error().Err(err).Msgf("Sending %v command failed", command.commandName)
+	} else {
+		commandsSentTotal.WithLabelValues(command.commandName, "success").Inc()
+		mp.requestTracker.Register(command)
+		mp.requestMutex.Lock()
+		mp.lastSentCommandKey = getEchoKey(commandCode, destination, payload, command.broadcast)
+		mp.requestMutex.Unlock()
+	}
+}
+
+func (mp *messageProcessorImpl) SetControllerMode(mode string, until *time.Time) error {
+
+	if _, knownMode := reverseControllerModeMap[mode]; !knownMode {
+		return fmt.Errorf("Controller mode %v is unknown", mode)
+	}
+	if until != nil && !IsTemporaryMode(mode) {
+		return fmt.Errorf("Controller mode %v can't be set until a datetime", mode)
+	}
+
+	mp.requestMutex.Lock()
+	mp.requestedControllerMode = &ControllerMode{
+		Mode:  mode,
+		Until: until,
+	}
+	mp.requestMutex.Unlock()
+
+	log.Info().Msgf("Queueing controller_mode command for mode %v", mode)
+	mp.commandQueue <- Command{
+		messageType:   "W",
+		commandName:   "controller_mode",
+		destinationID: mp.controllerID,
+		payload: &ControllerModePayload{
+			Mode:  mode,
+			Until: until,
+		},
+	}
+
+	// request the mode afterwards in case the controller's broadcast confirming the change gets missed
+	mp.commandQueue <- Command{
+		messageType:   "RQ",
+		commandName:   "controller_mode",
+		destinationID: mp.controllerID,
+		interactive:   true,
+		payload: &DefaultPayload{
+			Values: []int{255},
+		},
+	}
+
+	return nil
+}
+
+func (mp *messageProcessorImpl) SetDhwMode(active bool, until *time.Time) error {
+
+	mode := "permanent_override"
+	if until != nil {
+		mode = "temporary_override"
+	}
+
+	return mp.queueDhwStateCommand(DhwStatePayload{
+		Active: active,
+		Mode:   mode,
+		Until:  until,
+	})
+}
+
+func (mp *messageProcessorImpl) BoostDhw(duration time.Duration) error {
+
+	if duration <= 0 {
+		return fmt.Errorf("Dhw boost duration %v is invalid", duration)
+	}
+
+	until := time.Now().Add(duration)
+
+	return mp.queueDhwStateCommand(DhwStatePayload{
+		Active: true,
+		Mode:   "temporary_override",
+		Until:  &until,
+	})
+}
+
+func (mp *messageProcessorImpl) ResetDhwMode() error {
+
+	return mp.queueDhwStateCommand(DhwStatePayload{
+		Mode: "follow_schedule",
+	})
+}
+
+func (mp *messageProcessorImpl) SetDhwSettings(setpoint float64, overrun int, differential float64) error {
+
+	if math.IsNaN(setpoint) || math.IsInf(setpoint, 0) {
+		return fmt.Errorf("Dhw setpoint %v isn't a number", setpoint)
+	}
+	if setpoint < 30 || setpoint > 85 {
+		return fmt.Errorf("Dhw setpoint %v is outside of the range 30 to 85", setpoint)
+	}
+	if overrun < 0 || overrun > 10 {
+		return fmt.Errorf("Dhw overrun %v is outside of the range 0 to 10", overrun)
+	}
+	if math.IsNaN(differential) || differential < 1 || differential > 10 {
+		return fmt.Errorf("Dhw differential %v is outside of the range 1 to 10", differential)
+	}
+
+	payload := DhwSettingsPayload{
+		Setpoint:     setpoint,
+		Overrun:      overrun,
+		Differential: differential,
+	}
+	mp.requestMutex.Lock()
+	mp.requestedDhwSettings = &payload
+	mp.requestMutex.Unlock()
+
+	log.Info().Msgf("Queueing dhw_settings command for setpoint %v", setpoint)
+	mp.commandQueue <- Command{
+		messageType:   "W",
+		commandName:   "dhw_settings",
+		destinationID: mp.controllerID,
+		payload:       &payload,
+	}
+
+	// request the settings afterwards to confirm the change
+	mp.commandQueue <- Command{
+		messageType:   "RQ",
+		commandName:   "dhw_settings",
+		destinationID: mp.controllerID,
+		interactive:   true,
+		payload: &DefaultPayload{
+			Values: []int{0},
+		},
+	}
+
+	return nil
+}
+
+func (mp *messageProcessorImpl) SetZoneSetpoint(zoneID int64, setpoint float64, until *time.Time) error {
+
+	zoneInfo, known := mp.stateStore.GetZoneInfo(zoneID)
+	if !known || !zoneInfo.IsActualZone() {
+		return fmt.Errorf("Zone %v is unknown", zoneID)
+	}
+	if math.IsNaN(setpoint) || math.IsInf(setpoint, 0) {
+		return fmt.Errorf("Setpoint %v for zone %v isn't a number", setpoint, zoneInfo.Name)
+	}
+	if setpoint < 5 || setpoint > 35 {
+		return fmt.Errorf("Setpoint %v for zone %v is outside of the range 5 to 35", setpoint, zoneInfo.Name)
+	}
+	if zoneInfo.MinTemperature != 0 && zoneInfo.MaxTemperature != 0 && (setpoint < zoneInfo.MinTemperature || setpoint > zoneInfo.MaxTemperature) {
+		return fmt.Errorf("Setpoint %v for zone %v is outside of the range %v to %v", setpoint, zoneInfo.Name, zoneInfo.MinTemperature, zoneInfo.MaxTemperature)
+	}
+	if until != nil && until.Before(time.Now()) {
+		return fmt.Errorf("Setpoint for zone %v requires an until datetime in the future", zoneInfo.Name)
+	}
+
+	mode := "permanent_override"
+	if until != nil {
+		mode = "temporary_override"
+	}
+
+	return mp.queueSetpointOverrideCommand(SetpointOverridePayload{
+		ZoneID:   zoneID,
+		Setpoint: setpoint,
+		Mode:     mode,
+		Until:    until,
+	})
+}
+
+func (mp *messageProcessorImpl) ResetZoneSetpoint(zoneID int64) error {
+
+	zoneInfo, known := mp.stateStore.GetZoneInfo(zoneID)
+	if !known || !zoneInfo.IsActualZone() {
+		return fmt.Errorf("Zone %v is unknown", zoneID)
+	}
+
+	return mp.queueSetpointOverrideCommand(SetpointOverridePayload{
+		ZoneID: zoneID,
+		Mode:   "follow_schedule",
+	})
+}
+
+func (mp *messageProcessorImpl) queueSetpointOverrideCommand(payload SetpointOverridePayload) error {
+
+	log.Info().Msgf("Queueing setpoint_override command for zone %v with mode %v", payload.ZoneID, payload.Mode)
+	mp.commandQueue <- Command{
+		messageType:   "W",
+		commandName:   "setpoint_override",
+		destinationID: mp.controllerID,
+		payload:       &payload,
+	}
+
+	// request the setpoint afterwards, the controller only broadcasts all setpoints once every cycle
+	mp.commandQueue <- Command{
+		messageType:   "RQ",
+		commandName:   "setpoint",
+		destinationID: mp.controllerID,
+		interactive:   true,
+		payload: &DefaultPayload{
+			Values: []int{int(payload.ZoneID)},
+		},
+	}
+
+	return nil
+}
+
+func (mp *messageProcessorImpl) queueDhwStateCommand(payload DhwStatePayload) error {
+
+	if payload.Mode == "temporary_override" && (payload.Until == nil || payload.Until.Before(time.Now())) {
+		return fmt.Errorf("Dhw mode %v requires an until datetime in the future", payload.Mode)
+	}
+
+	mp.requestMutex.Lock()
+	mp.requestedDhwState = &payload
+	mp.requestMutex.Unlock()
+
+	log.Info().Msgf("Queueing dhw_state command for mode %v", payload.Mode)
+	mp.commandQueue <- Command{
+		messageType:   "W",
+		commandName:   "dhw_state",
+		destinationID: mp.controllerID,
+		payload:       &payload,
+	}
+
+	// request the state afterwards in case the controller's broadcast confirming the change gets missed
+	mp.commandQueue <- Command{
+		messageType:   "RQ",
+		commandName:   "dhw_state",
+		destinationID: mp.controllerID,
+		interactive:   true,
+		payload: &DefaultPayload{
+			Values: []int{0},
+		},
+	}
+
+	return nil
+}
+
+// isOwnEcho checks whether the message is the gateway repeating the last command sent by this application, learning the gateway id from it if it's not known yet
+func (mp *messageProcessorImpl) isOwnEcho(message Message) bool {
+
+	if message.GetSourceTypeName() != "DGW" {
+		return false
+	}
+
+	mp.requestMutex.Lock()
+	defer mp.requestMutex.Unlock()
+
+	if mp.lastSentCommandKey == "" {
+		return false
+	}
+
+	gatewayID := mp.gatewayIdentity.GetID()
+	if gatewayID != "" && message.source != gatewayID {
+		return false
+	}
+
+	// the gateway replaces the placeholder source id with its own when transmitting, for broadcasts the destination as well
+	broadcast := message.destination == message.source
+	if !strings.EqualFold(getEchoKey(message.command, message.destination, message.payload, broadcast), mp.lastSentCommandKey) {
+		return false
+	}
+
+	// a command is echoed once, anything else the gateway sends is processed like any other message
+	mp.lastSentCommandKey = ""
+
+	if gatewayID == "" {
+		mp.gatewayIdentity.Learn(message.source, "echo of sent command")
+	}
+
+	return true
+}
+
+// getEchoKey identifies a sent command in the gateway's echo of it; broadcasts leave out the destination, since it's the id of the gateway
+func getEchoKey(commandCode, destination, payload string, broadcast bool) string {
+
+	if broadcast {
+		destination = "--:------"
 	}
 
-	// wait for serial port to stabilise
-	time.Sleep(time.Duration(2) * time.Second)
+	return fmt.Sprintf("%v|%v|%v", commandCode, destination, payload)
 }
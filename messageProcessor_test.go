@@ -0,0 +1,243 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsOwnEcho(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		gatewayID         string
+		command           Command
+		rawmsg            string
+		expectedEcho      bool
+		expectedGatewayID string
+	}{
+		{
+			name:              "echo of request learns gateway id",
+			command:           Command{messageType: "RQ", commandName: "zone_name", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{2, 0}}},
+			rawmsg:            "--- RQ --- 18:123456 01:160371 --:------ 0004 002 0200",
+			expectedEcho:      true,
+			expectedGatewayID: "18:123456",
+		},
+		{
+			name:              "echo of broadcast has the gateway as destination",
+			command:           Command{messageType: "I", commandName: "zone_temperature", broadcast: true, payload: &DefaultPayload{Values: []int{1, 7, 208}}},
+			rawmsg:            "---  I --- 18:123456 --:------ 18:123456 30C9 003 0107D0",
+			expectedEcho:      true,
+			expectedGatewayID: "18:123456",
+		},
+		{
+			name:              "other frame of known gateway",
+			gatewayID:         "18:123456",
+			command:           Command{messageType: "RQ", commandName: "zone_name", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{2, 0}}},
+			rawmsg:            "---  I --- 18:123456 --:------ 18:123456 1F09 003 FF0532",
+			expectedEcho:      false,
+			expectedGatewayID: "18:123456",
+		},
+		{
+			name:              "same command from another gateway",
+			gatewayID:         "18:123456",
+			command:           Command{messageType: "RQ", commandName: "zone_name", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{2, 0}}},
+			rawmsg:            "--- RQ --- 18:654321 01:160371 --:------ 0004 002 0200",
+			expectedEcho:      false,
+			expectedGatewayID: "18:123456",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gatewayIdentity := NewGatewayIdentity(test.gatewayID)
+			requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+			messageProcessor := NewMessageProcessor("01:160371", gatewayIdentity, nil, nil, make(chan Command, 10), requestTracker, NewStateStore("01:160371", time.Hour)).(*messageProcessorImpl)
+
+			messageProcessor.SendCommand(&collectingLineWriter{}, test.command)
+			message := messageProcessor.DecodeMessage(test.rawmsg, time.Now())
+
+			if echo := messageProcessor.isOwnEcho(message); echo != test.expectedEcho {
+				t.Errorf("expected echo %v, got %v", test.expectedEcho, echo)
+			}
+			if gatewayIdentity.GetID() != test.expectedGatewayID {
+				t.Errorf("expected gateway id %v, got %v", test.expectedGatewayID, gatewayIdentity.GetID())
+			}
+
+			// the echo is only dropped once
+			if messageProcessor.isOwnEcho(message) {
+				t.Errorf("expected repeated frame not to be an echo")
+			}
+		})
+	}
+}
+
+// collectingLineWriter keeps all lines written to it in memory
+type collectingLineWriter struct {
+	lines []string
+}
+
+func (cw *collectingLineWriter) WriteLine(line string) error {
+	cw.lines = append(cw.lines, line)
+	return nil
+}
+
+func TestMessageProcessorQueuesCommandsWhileProcessingMessages(t *testing.T) {
+
+	commandQueue := make(chan Command, 10)
+	requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+	messageProcessor := NewMessageProcessor("01:160371", NewGatewayIdentity("18:123456"), &collectingMeasurementSink{}, nil, commandQueue, requestTracker, NewStateStore("01:160371", time.Hour))
+
+	// commands come in from the mqtt goroutine, while the main loop sends them and processes the controller's responses
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			messageProcessor.SetControllerMode("eco", nil)
+			messageProcessor.SetDhwSettings(50, 5, 10)
+			messageProcessor.ResetDhwMode()
+		}
+	}()
+
+	writer := &collectingLineWriter{}
+	for sent := 0; sent < 300; sent++ {
+		messageProcessor.SendCommand(writer, <-commandQueue)
+		messageProcessor.ProcessMessage(messageProcessor.DecodeMessage("---  I --- 01:160371 --:------ 01:160371 2E04 008 02FFFFFFFFFFFF00", time.Now()))
+		messageProcessor.ProcessMessage(messageProcessor.DecodeMessage("--- RP --- 01:160371 18:123456 --:------ 10A0 006 0013880503E8", time.Now()))
+		messageProcessor.ProcessMessage(messageProcessor.DecodeMessage("--- RP --- 01:160371 18:123456 --:------ 1F41 006 000000FFFFFF", time.Now()))
+	}
+	<-done
+
+	if len(writer.lines) != 300 {
+		t.Errorf("expected 300 sent commands, got %v", len(writer.lines))
+	}
+}
+
+// collectingEventSink keeps all events published to it in memory
+type collectingEventSink struct {
+	events []Event
+}
+
+func (cs *collectingEventSink) Publish(event Event) {
+	cs.events = append(cs.events, event)
+}
+
+func (cs *collectingEventSink) Close() error {
+	return nil
+}
+
+func (cs *collectingEventSink) String() string {
+	return "collecting event sink"
+}
+
+func TestProcessSetpointOverrideMessagePublishesEvent(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		rawmsg       string
+		expectedType string
+		expectedData map[string]interface{}
+	}{
+		{"permanent override", "045  I --- 01:160371 --:------ 01:160371 2349 007 0107D002FFFFFF", eventSetpointOverride, map[string]interface{}{"mode": "permanent_override", "setpoint": 20.0}},
+		{"override cleared", "045  I --- 01:160371 --:------ 01:160371 2349 007 017FFF00FFFFFF", eventOverrideCleared, map[string]interface{}{"mode": "follow_schedule"}},
+		{"response doesn't announce a change", "045 RP --- 01:160371 18:123456 --:------ 2349 007 0107D002FFFFFF", "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eventSink := &collectingEventSink{}
+			requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+			messageProcessor := NewMessageProcessor("01:160371", NewGatewayIdentity("18:123456"), &collectingMeasurementSink{}, eventSink, make(chan Command, 10), requestTracker, NewStateStore("01:160371", time.Hour))
+
+			// act
+			messageProcessor.ProcessMessage(messageProcessor.DecodeMessage(test.rawmsg, time.Now()))
+
+			if test.expectedType == "" {
+				if len(eventSink.events) != 0 {
+					t.Errorf("expected no events, got %+v", eventSink.events)
+				}
+				return
+			}
+			if len(eventSink.events) != 1 || eventSink.events[0].Type != test.expectedType {
+				t.Fatalf("expected a %v event, got %+v", test.expectedType, eventSink.events)
+			}
+			if len(eventSink.events[0].Data) != len(test.expectedData) {
+				t.Errorf("expected data %v, got %v", test.expectedData, eventSink.events[0].Data)
+			}
+			for key, value := range test.expectedData {
+				if eventSink.events[0].Data[key] != value {
+					t.Errorf("expected %v to be %v, got %v", key, value, eventSink.events[0].Data[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSilentDevicesCountsFromPersistedState(t *testing.T) {
+
+	now := time.Now().UTC()
+	stateStore := NewStateStore("01:160371", time.Hour)
+	state := newInitialState()
+	state.ZoneInfoMap[1] = ZoneInfo{ID: 1, Name: "Living", Observations: ZoneObservations{
+		Temperature: FieldObservation{UpdatedAt: now.Add(-3 * time.Hour), Source: "04:000001"},
+		HeatDemand:  FieldObservation{UpdatedAt: now.Add(-30 * time.Minute), Source: "04:000002"},
+	}}
+	stateStore.Restore(state)
+
+	eventSink := &collectingEventSink{}
+	requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+	messageProcessor := NewMessageProcessor("01:160371", NewGatewayIdentity("18:123456"), &collectingMeasurementSink{}, eventSink, make(chan Command, 10), requestTracker, stateStore)
+
+	// act
+	messageProcessor.CheckSilentDevices(2 * time.Hour)
+
+	if len(eventSink.events) != 1 || eventSink.events[0].Type != eventDeviceSilent || eventSink.events[0].DeviceID != "04:000001" {
+		t.Fatalf("expected a device_silent event for 04:000001 only, got %+v", eventSink.events)
+	}
+	if eventSink.events[0].ZoneName != "Living" {
+		t.Errorf("expected the event to be for zone Living, got %v", eventSink.events[0].ZoneName)
+	}
+}
+
+func TestProcessZoneValuesSkipsMissingValues(t *testing.T) {
+
+	lastHeard := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                string
+		rawmsg              string
+		expectedTemperature float64
+		expectedSetpoint    float64
+	}{
+		{"temperature without sensor", "045  I --- 01:160371 --:------ 01:160371 30C9 006 00081A017FFF", 20.5, 19},
+		{"setpoint out of range", "045  I --- 01:160371 --:------ 01:160371 2309 006 00079E017FFF", 20.5, 19},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateStore := NewStateStore("01:160371", time.Hour)
+			state := newInitialState()
+			state.ZoneInfoMap[1] = ZoneInfo{ID: 1, Name: "Living", Temperature: 20.5, Setpoint: 19, LastHeard: lastHeard}
+			stateStore.Restore(state)
+
+			requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+			messageProcessor := NewMessageProcessor("01:160371", NewGatewayIdentity("18:123456"), &collectingMeasurementSink{}, nil, make(chan Command, 10), requestTracker, stateStore)
+
+			// act
+			messageProcessor.ProcessMessage(messageProcessor.DecodeMessage(test.rawmsg, lastHeard.Add(time.Minute)))
+
+			zoneInfo, _ := stateStore.GetZoneInfo(1)
+			if zoneInfo.Temperature != test.expectedTemperature {
+				t.Errorf("expected temperature %v, got %v", test.expectedTemperature, zoneInfo.Temperature)
+			}
+			if zoneInfo.Setpoint != test.expectedSetpoint {
+				t.Errorf("expected setpoint %v, got %v", test.expectedSetpoint, zoneInfo.Setpoint)
+			}
+			if !zoneInfo.LastHeard.Equal(lastHeard) {
+				t.Errorf("expected last heard %v, got %v", lastHeard, zoneInfo.LastHeard)
+			}
+			if _, known := stateStore.GetZoneInfo(0); !known {
+				t.Errorf("expected the valid block for zone 0 to still be processed")
+			}
+		})
+	}
+}
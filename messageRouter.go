@@ -0,0 +1,52 @@
+package main
+
+// MessageRouter is the interface for handing messages and commands to the message processor of the controller they belong to
+type MessageRouter interface {
+	ProcessorForMessage(message Message) (messageProcessor MessageProcessor, ok bool)
+	ProcessorForCommand(command Command) MessageProcessor
+}
+
+type messageRouterImpl struct {
+	controllerIDs     []string
+	messageProcessors map[string]MessageProcessor
+}
+
+// NewMessageRouter returns new MessageRouter; with a single controller all messages go to it, with multiple controllers messages that can't be tied to any of them aren't routed
+func NewMessageRouter(controllerIDs []string, messageProcessors map[string]MessageProcessor) MessageRouter {
+	return &messageRouterImpl{
+		controllerIDs:     controllerIDs,
+		messageProcessors: messageProcessors,
+	}
+}
+
+func (mr *messageRouterImpl) ProcessorForMessage(message Message) (MessageProcessor, bool) {
+
+	// messages sent by a controller belong to it, otherwise the controller they're addressed to
+	if messageProcessor, ok := mr.messageProcessors[message.source]; ok {
+		return messageProcessor, true
+	}
+	if messageProcessor, ok := mr.messageProcessors[message.destination]; ok {
+		return messageProcessor, true
+	}
+
+	if len(mr.controllerIDs) == 1 {
+		return mr.messageProcessors[mr.controllerIDs[0]], true
+	}
+
+	// broadcasts of devices like radiator valves belong to the controller they've been seen exchanging messages with
+	for _, controllerID := range mr.controllerIDs {
+		if messageProcessor := mr.messageProcessors[controllerID]; messageProcessor.KnowsDevice(message.source) {
+			return messageProcessor, true
+		}
+	}
+
+	return nil, false
+}
+
+func (mr *messageRouterImpl) ProcessorForCommand(command Command) MessageProcessor {
+	if messageProcessor, ok := mr.messageProcessors[command.destinationID]; ok {
+		return messageProcessor
+	}
+
+	return mr.messageProcessors[mr.controllerIDs[0]]
+}
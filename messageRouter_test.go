@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageRouterProcessorForMessage(t *testing.T) {
+
+	tests := []struct {
+		name               string
+		controllerIDs      []string
+		learnFrom          []string
+		rawmsg             string
+		expectedController string
+	}{
+		{
+			name:               "sent by a controller",
+			controllerIDs:      []string{"01:111111", "01:222222"},
+			rawmsg:             "045  I --- 01:222222 --:------ 01:222222 30C9 003 0107D0",
+			expectedController: "01:222222",
+		},
+		{
+			name:               "addressed to a controller",
+			controllerIDs:      []string{"01:111111", "01:222222"},
+			rawmsg:             "045  I --- 04:100000 01:222222 --:------ 3150 002 0132",
+			expectedController: "01:222222",
+		},
+		{
+			name:               "broadcast of a device heard talking to a controller",
+			controllerIDs:      []string{"01:111111", "01:222222"},
+			learnFrom:          []string{"045  I --- 04:100000 01:222222 --:------ 3150 002 0132"},
+			rawmsg:             "045  I --- 04:100000 --:------ 04:100000 1060 003 00FF01",
+			expectedController: "01:222222",
+		},
+		{
+			name:               "broadcast of a device a controller talked to",
+			controllerIDs:      []string{"01:111111", "01:222222"},
+			learnFrom:          []string{"045 RQ --- 01:222222 13:100000 --:------ 3EF0 001 00"},
+			rawmsg:             "045  I --- 13:100000 --:------ 13:100000 3EF0 003 00C8FF",
+			expectedController: "01:222222",
+		},
+		{
+			name:               "broadcast of a device listed by a controller",
+			controllerIDs:      []string{"01:111111", "01:222222"},
+			learnFrom:          []string{"045 RP --- 01:222222 18:100000 --:------ 000C 012 010000104DB2010001104DB5"},
+			rawmsg:             "045  I --- 04:019890 --:------ 04:019890 12B0 003 01C800",
+			expectedController: "01:222222",
+		},
+		{
+			name:          "broadcast of an unknown device",
+			controllerIDs: []string{"01:111111", "01:222222"},
+			learnFrom:     []string{"045  I --- 04:100000 01:222222 --:------ 3150 002 0132"},
+			rawmsg:        "045  I --- 04:100001 --:------ 04:100001 1060 003 00FF01",
+		},
+		{
+			name:          "broadcast of a gateway",
+			controllerIDs: []string{"01:111111", "01:222222"},
+			learnFrom:     []string{"045 RQ --- 18:100000 01:222222 --:------ 0004 002 0100"},
+			rawmsg:        "045  I --- 18:100000 --:------ 18:100000 1F09 003 FF0532",
+		},
+		{
+			name:               "broadcast of an unknown device with a single controller",
+			controllerIDs:      []string{"01:111111"},
+			rawmsg:             "045  I --- 04:100001 --:------ 04:100001 1060 003 00FF01",
+			expectedController: "01:111111",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messageProcessors := map[string]MessageProcessor{}
+			for _, controllerID := range test.controllerIDs {
+				requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+				messageProcessors[controllerID] = NewMessageProcessor(controllerID, NewGatewayIdentity(""), &collectingMeasurementSink{}, nil, make(chan Command, 10), requestTracker, NewStateStore(controllerID, time.Hour))
+			}
+			messageRouter := NewMessageRouter(test.controllerIDs, messageProcessors)
+
+			for _, rawmsg := range test.learnFrom {
+				message := messageProcessors[test.controllerIDs[0]].DecodeMessage(rawmsg, time.Now())
+				if messageProcessor, ok := messageRouter.ProcessorForMessage(message); ok {
+					messageProcessor.ProcessMessage(message)
+				}
+			}
+
+			message := messageProcessors[test.controllerIDs[0]].DecodeMessage(test.rawmsg, time.Now())
+			messageProcessor, ok := messageRouter.ProcessorForMessage(message)
+
+			if test.expectedController == "" {
+				if ok {
+					t.Errorf("expected message not to be routed, got %v", messageProcessor)
+				}
+				return
+			}
+			if !ok || messageProcessor != messageProcessors[test.expectedController] {
+				t.Errorf("expected message to be routed to %v", test.expectedController)
+			}
+		})
+	}
+}
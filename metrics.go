@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	commandResponsesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_command_responses_total",
+			Help: "Total number of sent commands by outcome; success, retry or failed.",
+		},
+		[]string{"command", "result"},
+	)
+
+	commandResponseLatencySeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "evohome_command_response_latency_seconds",
+			Help:    "Time between sending a command and receiving its response.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+		},
+		[]string{"command"},
+	)
+
+	commandQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_command_queue_depth",
+			Help: "Number of commands waiting to be sent by priority; interactive or background.",
+		},
+		[]string{"priority"},
+	)
+
+	transportReconnectsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_transport_reconnects_total",
+			Help: "Total number of transport reconnects by reason; error or silence.",
+		},
+		[]string{"reason"},
+	)
+
+	transportSilentPeriodSeconds = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "evohome_transport_silent_period_seconds",
+			Help:    "Duration of periods longer than a minute without receiving anything from the transport.",
+			Buckets: []float64{60, 120, 300, 600, 1800, 3600},
+		},
+	)
+
+	measurementBacklog = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_measurement_backlog",
+			Help: "Number of measurements waiting to be written by sink.",
+		},
+		[]string{"sink"},
+	)
+
+	measurementFlushesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_measurement_flushes_total",
+			Help: "Total number of batches written to a sink by outcome; success, failed or dead_lettered when the sink rejected them permanently.",
+		},
+		[]string{"sink", "result"},
+	)
+
+	measurementsDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_measurements_dropped_total",
+			Help: "Total number of measurements dropped because the backlog of a sink was full.",
+		},
+		[]string{"sink"},
+	)
+
+	zoneTemperatureCelsius = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_zone_temperature_celsius",
+			Help: "Measured temperature of a zone.",
+		},
+		[]string{"controller", "zone_id", "zone_name"},
+	)
+
+	zoneSetpointCelsius = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_zone_setpoint_celsius",
+			Help: "Setpoint of a zone.",
+		},
+		[]string{"controller", "zone_id", "zone_name"},
+	)
+
+	zoneHeatDemandPercent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_zone_heat_demand_percent",
+			Help: "Heat demand of a zone.",
+		},
+		[]string{"controller", "zone_id", "zone_name"},
+	)
+
+	zoneMinTemperatureCelsius = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_zone_min_temperature_celsius",
+			Help: "Lowest setpoint allowed for a zone.",
+		},
+		[]string{"controller", "zone_id", "zone_name"},
+	)
+
+	zoneMaxTemperatureCelsius = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_zone_max_temperature_celsius",
+			Help: "Highest setpoint allowed for a zone.",
+		},
+		[]string{"controller", "zone_id", "zone_name"},
+	)
+
+	dhwTemperatureCelsius = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_dhw_temperature_celsius",
+			Help: "Measured temperature of the domestic hot water.",
+		},
+		[]string{"controller"},
+	)
+
+	boilerModulationPercent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_boiler_modulation_percent",
+			Help: "Modulation level reported by the boiler or its relay.",
+		},
+		[]string{"controller", "device"},
+	)
+
+	deviceBatteryPercent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_device_battery_percent",
+			Help: "Battery level reported by a device.",
+		},
+		[]string{"device"},
+	)
+
+	deviceBatteryLow = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_device_battery_low",
+			Help: "1 when a device reports its battery is low, 0 otherwise.",
+		},
+		[]string{"device"},
+	)
+
+	deviceRSSI = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "evohome_device_rssi",
+			Help: "Signal strength of the last frame received from a device, as reported by the gateway.",
+		},
+		[]string{"device"},
+	)
+
+	framesReceivedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_frames_received_total",
+			Help: "Total number of frames received by gateway.",
+		},
+		[]string{"gateway"},
+	)
+
+	framesRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_frames_rejected_total",
+			Help: "Total number of received frames that weren't processed by reason; too_short, error, invalid, duplicate or unattributed.",
+		},
+		[]string{"reason"},
+	)
+
+	commandsSentTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_commands_sent_total",
+			Help: "Total number of commands written to the gateway by outcome; success or failed.",
+		},
+		[]string{"command", "result"},
+	)
+
+	requestTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_request_timeouts_total",
+			Help: "Total number of sent commands that didn't get a response in time.",
+		},
+		[]string{"command"},
+	)
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evohome_webhook_deliveries_total",
+			Help: "Total number of events posted to webhooks by outcome; delivered, failed or dropped.",
+		},
+		[]string{"event", "result"},
+	)
+)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testMQTTMessage is a received mqtt message with just a topic and payload
+type testMQTTMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (m *testMQTTMessage) Duplicate() bool   { return false }
+func (m *testMQTTMessage) Qos() byte         { return 1 }
+func (m *testMQTTMessage) Retained() bool    { return m.retained }
+func (m *testMQTTMessage) Topic() string     { return m.topic }
+func (m *testMQTTMessage) MessageID() uint16 { return 0 }
+func (m *testMQTTMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMQTTMessage) Ack()              {}
+
+func TestHandleCommand(t *testing.T) {
+
+	tests := []struct {
+		name             string
+		topic            string
+		payload          string
+		retained         bool
+		expectedCommands []string
+	}{
+		{"zone setpoint", "evohome/01-160371/zone/1/setpoint/set", "21.5", false, []string{"setpoint_override", "setpoint"}},
+		{"zone setpoint that isn't a number", "evohome/01-160371/zone/1/setpoint/set", "NaN", false, nil},
+		{"infinite zone setpoint", "evohome/01-160371/zone/1/setpoint/set", "+Inf", false, nil},
+		{"negative zone setpoint", "evohome/01-160371/zone/1/setpoint/set", "-5", false, nil},
+		{"zone setpoint above the range", "evohome/01-160371/zone/1/setpoint/set", "40", false, nil},
+		{"zone setpoint above the range without known limits", "evohome/01-160371/zone/2/setpoint/set", "40", false, nil},
+		{"negative zone setpoint without known limits", "evohome/01-160371/zone/2/setpoint/set", "-5", false, nil},
+		{"dhw setpoint", "evohome/01-160371/dhw/setpoint/set", "60", false, []string{"dhw_settings", "dhw_settings"}},
+		{"dhw setpoint that isn't a number", "evohome/01-160371/dhw/setpoint/set", "NaN", false, nil},
+		{"infinite dhw setpoint", "evohome/01-160371/dhw/setpoint/set", "Inf", false, nil},
+		{"negative dhw setpoint", "evohome/01-160371/dhw/setpoint/set", "-5", false, nil},
+		{"retained command", "evohome/01-160371/zone/1/setpoint/set", "21.5", true, nil},
+		{"unknown controller", "evohome/01-999999/zone/1/setpoint/set", "21.5", false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateStore := NewStateStore("01:160371", time.Hour)
+			state := newInitialState()
+			state.ZoneInfoMap[1] = ZoneInfo{ID: 1, Name: "Living", MinTemperature: 5, MaxTemperature: 35}
+			state.ZoneInfoMap[2] = ZoneInfo{ID: 2, Name: "Kitchen"}
+			state.DhwInfo = DhwInfo{Setpoint: 55, Differential: 10}
+			stateStore.Restore(state)
+
+			commandQueue := make(chan Command, 10)
+			requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+			messageProcessor := NewMessageProcessor("01:160371", NewGatewayIdentity("18:123456"), &collectingMeasurementSink{}, nil, commandQueue, requestTracker, stateStore)
+			publisher := &mqttPublisherImpl{
+				topicPrefix: "evohome",
+				controllers: []controller{{id: "01:160371", stateStore: stateStore, messageProcessor: messageProcessor}},
+			}
+
+			// act
+			publisher.handleCommand(nil, &testMQTTMessage{topic: test.topic, payload: test.payload, retained: test.retained})
+
+			close(commandQueue)
+			commands := []string{}
+			for command := range commandQueue {
+				commands = append(commands, command.commandName)
+			}
+			if len(commands) != len(test.expectedCommands) {
+				t.Fatalf("expected commands %v, got %v", test.expectedCommands, commands)
+			}
+			for i := range commands {
+				if commands[i] != test.expectedCommands[i] {
+					t.Errorf("expected commands %v, got %v", test.expectedCommands, commands)
+				}
+			}
+		})
+	}
+}
+
+func TestObservedTemperature(t *testing.T) {
+
+	received := FieldObservation{UpdatedAt: time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	tests := []struct {
+		name        string
+		value       float64
+		observation FieldObservation
+		expected    *float64
+	}{
+		{"received temperature", 20.5, received, floatPointer(20.5)},
+		{"temperature that hasn't been received", 0, FieldObservation{}, nil},
+		{"missing sensor", 327.67, received, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// act
+			actual := observedTemperature(test.value, test.observation)
+
+			if (actual == nil) != (test.expected == nil) || (actual != nil && *actual != *test.expected) {
+				t.Errorf("expected %v, got %v", formatFloatPointer(test.expected), formatFloatPointer(actual))
+			}
+		})
+	}
+}
+
+func formatFloatPointer(value *float64) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
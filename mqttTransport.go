@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+type mqttTransportImpl struct {
+	brokerURL string
+	username  string
+	password  string
+	baseTopic string
+	client    mqtt.Client
+	lines     chan string
+}
+
+type mqttGatewayMessage struct {
+	Timestamp string `json:"ts,omitempty"`
+	Message   string `json:"msg"`
+}
+
+// NewMQTTTransport returns a Transport for a radio bridge publishing frames to the rx topic and sending frames published to the tx topic below the url's path, like ramses_esp does
+func NewMQTTTransport(u *url.URL) Transport {
+
+	scheme := "tcp"
+	if u.Scheme == "mqtts" {
+		scheme = "ssl"
+	}
+
+	transport := &mqttTransportImpl{
+		brokerURL: fmt.Sprintf("%v://%v", scheme, u.Host),
+		baseTopic: strings.Trim(u.Path, "/"),
+		lines:     make(chan string, 100),
+	}
+
+	if u.User != nil {
+		transport.username = u.User.Username()
+		transport.password, _ = u.User.Password()
+	}
+
+	return transport
+}
+
+func (mt *mqttTransportImpl) Open() error {
+
+	options := mqtt.NewClientOptions().
+		AddBroker(mt.brokerURL).
+		SetClientID(fmt.Sprintf("evohome-hgi80-listener-%v", time.Now().UnixNano())).
+		SetUsername(mt.username).
+		SetPassword(mt.password).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// (re)subscribe on every connect, since the session isn't persisted
+			token := client.Subscribe(mt.baseTopic+"/rx", 0, mt.handleMessage)
+			if token.Wait() && token.Error() != nil {
+				log.Error().Err(token.Error()).Msgf("Failed subscribing to mqtt topic %v/rx", mt.baseTopic)
+			}
+		})
+
+	// the client keeps reconnecting in the background once created, so disconnect it on every failure to not leak it
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		client.Disconnect(0)
+		return fmt.Errorf("Timed out connecting to mqtt broker %v", mt.brokerURL)
+	}
+	if token.Error() != nil {
+		client.Disconnect(0)
+		return token.Error()
+	}
+	if !client.IsConnected() {
+		client.Disconnect(0)
+		return fmt.Errorf("Failed connecting to mqtt broker %v", mt.brokerURL)
+	}
+
+	mt.client = client
+
+	return nil
+}
+
+func (mt *mqttTransportImpl) Close() error {
+	if mt.client == nil {
+		return nil
+	}
+
+	mt.client.Disconnect(250)
+	mt.client = nil
+
+	return nil
+}
+
+func (mt *mqttTransportImpl) ReadLine() (string, time.Time, error) {
+
+	// time out like the serial port does, to give the caller the chance to send commands
+	select {
+	case line := <-mt.lines:
+		return line, time.Now().UTC(), nil
+	case <-time.After(2 * time.Second):
+		if mt.client == nil || !mt.client.IsConnected() {
+			return "", time.Time{}, errors.New("Connection to mqtt broker is lost")
+		}
+		return "", time.Time{}, io.EOF
+	}
+}
+
+func (mt *mqttTransportImpl) WriteLine(line string) error {
+
+	data, err := json.Marshal(mqttGatewayMessage{
+		Message: line,
+	})
+	if err != nil {
+		return err
+	}
+
+	if mt.client == nil {
+		return errors.New("Connection to mqtt broker is closed")
+	}
+
+	token := mt.client.Publish(mt.baseTopic+"/tx", 0, false, data)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("Timed out publishing to mqtt topic %v/tx", mt.baseTopic)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+func (mt *mqttTransportImpl) String() string {
+	return fmt.Sprintf("mqtt://%v/%v", strings.SplitN(mt.brokerURL, "://", 2)[1], mt.baseTopic)
+}
+
+func (mt *mqttTransportImpl) handleMessage(client mqtt.Client, mqttMessage mqtt.Message) {
+
+	var gatewayMessage mqttGatewayMessage
+	if err := json.Unmarshal(mqttMessage.Payload(), &gatewayMessage); err != nil {
+		// some bridges publish the bare frame
+		gatewayMessage.Message = string(mqttMessage.Payload())
+	}
+
+	line := strings.TrimRight(gatewayMessage.Message, "\r\n")
+	if line == "" {
+		return
+	}
+
+	select {
+	case mt.lines <- line:
+	default:
+		log.Warn().Str("_msg", line).Msg("Mqtt receive buffer is full, dropping message")
+	}
+}
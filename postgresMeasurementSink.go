@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+type postgresMeasurementSinkImpl struct {
+	db         *sql.DB
+	schemaName string
+	tableName  string
+}
+
+// NewPostgresMeasurementSink returns a MeasurementSink inserting measurements into a PostgreSQL table with the same columns as the BigQuery table, creating the table or adding missing columns if needed and optionally turning it into a TimescaleDB hypertable partitioned on inserted_at
+func NewPostgresMeasurementSink(connectionString, table string, hypertable bool) (MeasurementSink, error) {
+
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ps := &postgresMeasurementSinkImpl{
+		db:        db,
+		tableName: table,
+	}
+	if parts := strings.SplitN(table, ".", 2); len(parts) == 2 {
+		ps.schemaName, ps.tableName = parts[0], parts[1]
+	}
+
+	err = ps.createOrUpdateTable(hypertable)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+func (ps *postgresMeasurementSinkImpl) Write(measurements []Measurement) error {
+	return classifyPostgresError(ps.copyMeasurements(measurements))
+}
+
+// copyMeasurements copies the measurements into the table in a single transaction
+func (ps *postgresMeasurementSinkImpl) copyMeasurements(measurements []Measurement) error {
+
+	columns := make([]string, 0, len(measurementColumns))
+	for _, column := range measurementColumns {
+		columns = append(columns, column.Name)
+	}
+
+	// copy is a lot faster than separate inserts and writes the batch all or nothing
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	copyStatement := pq.CopyIn(ps.tableName, columns...)
+	if ps.schemaName != "" {
+		copyStatement = pq.CopyInSchema(ps.schemaName, ps.tableName, columns...)
+	}
+
+	statement, err := tx.Prepare(copyStatement)
+	if err != nil {
+		return err
+	}
+
+	for _, measurement := range measurements {
+		values := make([]interface{}, 0, len(measurementColumns))
+		for _, column := range measurementColumns {
+			values = append(values, column.Value(measurement))
+		}
+
+		if _, err := statement.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+	if err := statement.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// classifyPostgresError marks data exceptions, constraint violations and schema errors as permanent, since the same rows fail again when retried
+func classifyPostgresError(err error) error {
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "22", "23", "42":
+			return newPermanentError(pqErr)
+		}
+	}
+
+	return err
+}
+
+func (ps *postgresMeasurementSinkImpl) Close() error {
+	return ps.db.Close()
+}
+
+func (ps *postgresMeasurementSinkImpl) String() string {
+	return fmt.Sprintf("postgres table %v", ps.qualifiedTableName())
+}
+
+// createOrUpdateTable creates the table if it doesn't exist yet and adds columns for fields added to the measurement since; like for bigquery columns are never removed or changed
+func (ps *postgresMeasurementSinkImpl) createOrUpdateTable(hypertable bool) error {
+
+	table := ps.qualifiedTableName()
+
+	columnDefinitions := []string{}
+	for _, column := range measurementColumns {
+		columnType, err := toPostgresColumnType(column)
+		if err != nil {
+			return err
+		}
+		definition := pq.QuoteIdentifier(column.Name) + " " + columnType
+		if column.Required {
+			definition += " NOT NULL"
+		}
+		columnDefinitions = append(columnDefinitions, definition)
+	}
+
+	log.Debug().Msgf("Creating table %v if it doesn't exist...", table)
+	_, err := ps.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v)", table, strings.Join(columnDefinitions, ", ")))
+	if err != nil {
+		return err
+	}
+
+	// rows inserted before a column got added have no value for it, so added columns are nullable
+	log.Debug().Msgf("Trying to update table %v schema...", table)
+	for _, column := range measurementColumns {
+		columnType, _ := toPostgresColumnType(column)
+		_, err := ps.db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN IF NOT EXISTS %v %v", table, pq.QuoteIdentifier(column.Name), columnType))
+		if err != nil {
+			return err
+		}
+	}
+
+	if hypertable {
+		log.Debug().Msgf("Converting table %v into a hypertable if it isn't one yet...", table)
+		_, err = ps.db.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb")
+		if err != nil {
+			return err
+		}
+		_, err = ps.db.Exec("SELECT create_hypertable($1, 'inserted_at', if_not_exists => TRUE, migrate_data => TRUE)", table)
+		return err
+	}
+
+	// a hypertable gets an index on the time column by itself
+	_, err = ps.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %v ON %v (inserted_at)", pq.QuoteIdentifier(ps.tableName+"_inserted_at_idx"), table))
+
+	return err
+}
+
+func (ps *postgresMeasurementSinkImpl) qualifiedTableName() string {
+	if ps.schemaName == "" {
+		return pq.QuoteIdentifier(ps.tableName)
+	}
+	return pq.QuoteIdentifier(ps.schemaName) + "." + pq.QuoteIdentifier(ps.tableName)
+}
+
+// toPostgresColumnType maps the type of a measurement column onto the matching postgres type
+func toPostgresColumnType(column measurementColumn) (string, error) {
+
+	switch column.Type {
+	case columnTypeString:
+		return "text", nil
+	case columnTypeInteger:
+		return "bigint", nil
+	case columnTypeFloat:
+		return "double precision", nil
+	case columnTypeBoolean:
+		return "boolean", nil
+	case columnTypeTimestamp:
+		return "timestamptz", nil
+	}
+
+	return "", fmt.Errorf("Column %v of type %v has no postgres equivalent", column.Name, column.Type)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestToPostgresColumnType(t *testing.T) {
+
+	expectedTypes := map[string]string{
+		"message_type": "text",
+		"broadcast":    "boolean",
+		"zone_id":      "bigint",
+		"temperature":  "double precision",
+		"inserted_at":  "timestamptz",
+	}
+
+	for _, column := range measurementColumns {
+		columnType, err := toPostgresColumnType(column)
+		if err != nil {
+			t.Errorf("expected column %v to have a postgres type, got %v", column.Name, err)
+		}
+		if expected, ok := expectedTypes[column.Name]; ok && columnType != expected {
+			t.Errorf("expected column %v to be %v, got %v", column.Name, expected, columnType)
+		}
+	}
+}
+
+func TestClassifyPostgresError(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		err               error
+		expectedPermanent bool
+	}{
+		{"invalid value", &pq.Error{Code: "22P02"}, true},
+		{"not null violation", &pq.Error{Code: "23502"}, true},
+		{"undefined column", &pq.Error{Code: "42703"}, true},
+		{"connection failure", &pq.Error{Code: "08006"}, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"network error", errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if permanent := isPermanentError(classifyPostgresError(test.err)); permanent != test.expectedPermanent {
+				t.Errorf("expected permanent %v, got %v", test.expectedPermanent, permanent)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type replayTransportImpl struct {
+	filePath         string
+	speed            float64
+	file             *os.File
+	lineReader       *lineReader
+	lastReceivedAt   time.Time
+	lastReplayedAt   time.Time
+	replayedMessages int
+}
+
+// NewReplayTransport returns a read-only Transport replaying a capture file at the speed of the original recording multiplied by speed, or as fast as possible if speed is 0
+func NewReplayTransport(filePath string, speed float64) Transport {
+	return &replayTransportImpl{
+		filePath: filePath,
+		speed:    speed,
+	}
+}
+
+func (rt *replayTransportImpl) Open() error {
+	file, err := os.Open(rt.filePath)
+	if err != nil {
+		return err
+	}
+
+	rt.file = file
+	rt.lineReader = newLineReader(bufio.NewReader(file))
+
+	return nil
+}
+
+func (rt *replayTransportImpl) Close() error {
+	if rt.file == nil {
+		return nil
+	}
+
+	err := rt.file.Close()
+	rt.file = nil
+
+	return err
+}
+
+func (rt *replayTransportImpl) ReadLine() (string, time.Time, error) {
+
+	for {
+		captureLine, err := rt.lineReader.readLine()
+		if err == io.EOF {
+			log.Info().Msgf("Replayed %v messages from %v", rt.replayedMessages, rt.filePath)
+			return "", time.Time{}, errTransportFinished
+		}
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		receivedAt, line, err := parseCaptureLine(captureLine)
+		if err != nil {
+			log.Warn().Err(err).Str("_msg", captureLine).Msg("Skipping invalid capture line")
+			continue
+		}
+
+		rt.waitForReplayTime(receivedAt)
+		rt.replayedMessages++
+
+		return line, receivedAt, nil
+	}
+}
+
+func (rt *replayTransportImpl) WriteLine(line string) error {
+	return errors.New("Replay transport is read-only")
+}
+
+func (rt *replayTransportImpl) String() string {
+	return fmt.Sprintf("replay://%v?speed=%v", rt.filePath, rt.speed)
+}
+
+// waitForReplayTime sleeps until the time between this and the previous line matches the recording, divided by the speed
+func (rt *replayTransportImpl) waitForReplayTime(receivedAt time.Time) {
+
+	if rt.speed > 0 && !rt.lastReceivedAt.IsZero() && receivedAt.After(rt.lastReceivedAt) {
+		delay := time.Duration(float64(receivedAt.Sub(rt.lastReceivedAt)) / rt.speed)
+		time.Sleep(delay - time.Since(rt.lastReplayedAt))
+	}
+
+	rt.lastReceivedAt = receivedAt
+	rt.lastReplayedAt = time.Now()
+}
+
+// parseCaptureLine splits a line written by the CaptureWriter into its receive time and raw line
+func parseCaptureLine(captureLine string) (receivedAt time.Time, line string, err error) {
+
+	parts := strings.SplitN(captureLine, " ", 2)
+	if len(parts) != 2 {
+		return receivedAt, line, errors.New("Capture line has no timestamp")
+	}
+
+	receivedAt, err = time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return receivedAt, line, err
+	}
+
+	return receivedAt.UTC(), parts[1], nil
+}
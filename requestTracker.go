@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RequestTracker is the interface for correlating sent commands with the responses of the devices they're sent to
+type RequestTracker interface {
+	Register(command Command)
+	Resolve(message Message)
+	Reject(message Message)
+	CheckTimeouts()
+	PendingCount() int
+}
+
+type pendingRequest struct {
+	command   Command
+	attempts  int
+	sentAt    time.Time
+	timeoutAt time.Time
+	rejected  bool
+}
+
+type requestTrackerImpl struct {
+	pendingRequests map[string]*pendingRequest
+	commandQueue    chan Command
+	timeout         time.Duration
+	maxAttempts     int
+	mutex           sync.Mutex
+}
+
+// NewRequestTracker returns new RequestTracker
+func NewRequestTracker(commandQueue chan Command, timeout time.Duration, maxAttempts int) RequestTracker {
+	return &requestTrackerImpl{
+		pendingRequests: map[string]*pendingRequest{},
+		commandQueue:    commandQueue,
+		timeout:         timeout,
+		maxAttempts:     maxAttempts,
+	}
+}
+
+func (rt *requestTrackerImpl) Register(command Command) {
+
+	// only requests and writes get a response
+	if command.broadcast || (command.messageType != "RQ" && command.messageType != "W") {
+		return
+	}
+
+	payload := ""
+	if command.payload != nil {
+		payload = command.payload.GetPayloadHex()
+	}
+	commandCode := reverseCommandsMap[command.commandName]
+	key := getRequestKey(command.messageType, commandCode, command.destinationID, payload)
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	// sending the same request again while it's pending counts as another attempt, so it still gives up in time
+	attempts := command.attempt
+	if pendingRequest, isPending := rt.pendingRequests[key]; isPending && pendingRequest.attempts > attempts {
+		attempts = pendingRequest.attempts
+	}
+	attempts++
+
+	// back off exponentially on every retry
+	now := time.Now().UTC()
+	rt.pendingRequests[key] = &pendingRequest{
+		command:   command,
+		attempts:  attempts,
+		sentAt:    now,
+		timeoutAt: now.Add(rt.timeout * time.Duration(math.Pow(2, float64(attempts-1)))),
+	}
+}
+
+func (rt *requestTrackerImpl) Resolve(message Message) {
+
+	// requests are answered with RP, writes with either an I or RP
+	if message.messageType != "RP" && message.messageType != "I" {
+		return
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	for _, key := range rt.findPendingRequests(message) {
+		pendingRequest := rt.pendingRequests[key]
+		if pendingRequest.rejected {
+			continue
+		}
+
+		delete(rt.pendingRequests, key)
+
+		latency := time.Since(pendingRequest.sentAt)
+		commandResponsesTotal.WithLabelValues(pendingRequest.command.commandName, "success").Inc()
+		commandResponseLatencySeconds.WithLabelValues(pendingRequest.command.commandName).Observe(latency.Seconds())
+
+		log.Debug().
+			Str("_msg", message.rawmsg).
+			Int("attempts", pendingRequest.attempts).
+			Dur("latency", latency).
+			Msgf("Received response for %v command", pendingRequest.command.commandName)
+	}
+}
+
+func (rt *requestTrackerImpl) Reject(message Message) {
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	// have the next timeout check retry the request straight away
+	for _, key := range rt.findPendingRequests(message) {
+		rt.pendingRequests[key].rejected = true
+		rt.pendingRequests[key].timeoutAt = time.Now().UTC()
+	}
+}
+
+func (rt *requestTrackerImpl) CheckTimeouts() {
+
+	rt.mutex.Lock()
+	retries := []Command{}
+	now := time.Now().UTC()
+	for key, pendingRequest := range rt.pendingRequests {
+		if now.Before(pendingRequest.timeoutAt) {
+			continue
+		}
+
+		delete(rt.pendingRequests, key)
+		requestTimeoutsTotal.WithLabelValues(pendingRequest.command.commandName).Inc()
+
+		if pendingRequest.attempts >= rt.maxAttempts {
+			commandResponsesTotal.WithLabelValues(pendingRequest.command.commandName, "failed").Inc()
+			log.Error().
+				Str("destination", pendingRequest.command.destinationID).
+				Int("attempts", pendingRequest.attempts).
+				Msgf("No valid response for %v command after %v attempts, giving up", pendingRequest.command.commandName, pendingRequest.attempts)
+			continue
+		}
+
+		commandResponsesTotal.WithLabelValues(pendingRequest.command.commandName, "retry").Inc()
+		log.Warn().
+			Str("destination", pendingRequest.command.destinationID).
+			Int("attempts", pendingRequest.attempts).
+			Bool("rejected", pendingRequest.rejected).
+			Msgf("No valid response for %v command, retrying...", pendingRequest.command.commandName)
+
+		command := pendingRequest.command
+		command.attempt = pendingRequest.attempts
+		retries = append(retries, command)
+	}
+	rt.mutex.Unlock()
+
+	// queue outside of the lock so a full queue doesn't block responses from being resolved
+	for _, command := range retries {
+		rt.commandQueue <- command
+	}
+}
+
+func (rt *requestTrackerImpl) PendingCount() int {
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	return len(rt.pendingRequests)
+}
+
+// findPendingRequests returns the keys of the pending requests a response answers; requests are answered with RP, writes with either an I or RP, so an RP answers both a write and the request sent after it to confirm the write
+func (rt *requestTrackerImpl) findPendingRequests(message Message) (keys []string) {
+
+	requestTypes := []string{"W", "RQ"}
+	if message.messageType == "I" {
+		requestTypes = []string{"W"}
+	}
+
+	for _, requestType := range requestTypes {
+		key := getRequestKey(requestType, message.command, message.source, message.payload)
+		if _, isPending := rt.pendingRequests[key]; isPending {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// getRequestKey identifies a request by message type, command code, the device it's sent to and the part of the payload that is echoed in the response
+func getRequestKey(messageType, commandCode, deviceID, payload string) string {
+
+	commandCode = strings.ToUpper(commandCode)
+
+	return fmt.Sprintf("%v|%v|%v|%v", strings.TrimSpace(messageType), commandCode, deviceID, getRequestContext(commandCode, strings.ToUpper(payload)))
+}
+
+func getRequestContext(commandCode, payload string) string {
+
+	switch commandCode {
+	case "2E04", "10E0", "313F":
+		// system wide, no context in payload
+		return ""
+	case "000C":
+		// zone index in byte 1 and device class in byte 2
+		if len(payload) >= 4 {
+			return payload[0:4]
+		}
+	case "0418":
+		// device index in byte 3
+		if len(payload) >= 6 {
+			return payload[4:6]
+		}
+	default:
+		// zone index in byte 1
+		if len(payload) >= 2 {
+			return payload[0:2]
+		}
+	}
+
+	return payload
+}
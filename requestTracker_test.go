@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetRequestKey(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		messageType string
+		commandCode string
+		deviceID    string
+		payload     string
+		expected    string
+	}{
+		{"zone in first byte", "RQ", "0004", "01:160371", "0200", "RQ|0004|01:160371|02"},
+		{"lowercase payload", "RP", "30c9", "01:160371", "0a07d0", "RP|30C9|01:160371|0A"},
+		{"system wide", "W", "2E04", "01:160371", "04FFFFFFFFFFFF00", "W|2E04|01:160371|"},
+		{"padded message type", " W", "2E04", "01:160371", "04FFFFFFFFFFFF00", "W|2E04|01:160371|"},
+		{"zone devices request", "RQ", "000C", "01:160371", "0104", "RQ|000C|01:160371|0104"},
+		{"zone devices response", "RP", "000C", "01:160371", "010400104DB2", "RP|000C|01:160371|0104"},
+		{"device index in third byte", "RQ", "0418", "01:160371", "000003", "RQ|0418|01:160371|03"},
+		{"short fault log payload", "RQ", "0418", "01:160371", "00", "RQ|0418|01:160371|00"},
+		{"empty payload", "RQ", "1F09", "01:160371", "", "RQ|1F09|01:160371|"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := getRequestKey(test.messageType, test.commandCode, test.deviceID, test.payload)
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRequestTrackerKeepsWriteAndRequestApart(t *testing.T) {
+
+	requestTracker := NewRequestTracker(make(chan Command, 10), time.Minute, 3)
+
+	requestTracker.Register(Command{messageType: "W", commandName: "controller_mode", destinationID: "01:160371", payload: &ControllerModePayload{Mode: "eco"}})
+	requestTracker.Register(Command{messageType: "RQ", commandName: "controller_mode", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{255}}})
+	if requestTracker.PendingCount() != 2 {
+		t.Fatalf("expected 2 pending requests, got %v", requestTracker.PendingCount())
+	}
+
+	// the controller confirms the write with a broadcast, which doesn't answer the request
+	requestTracker.Resolve(Message{messageType: "I", command: "2E04", source: "01:160371", payload: "01FFFFFFFFFFFF00"})
+	if requestTracker.PendingCount() != 1 {
+		t.Fatalf("expected 1 pending request after the broadcast, got %v", requestTracker.PendingCount())
+	}
+
+	requestTracker.Resolve(Message{messageType: "RP", command: "2E04", source: "01:160371", payload: "01FFFFFFFFFFFF00"})
+	if requestTracker.PendingCount() != 0 {
+		t.Fatalf("expected no pending requests after the response, got %v", requestTracker.PendingCount())
+	}
+}
+
+func TestRequestTrackerCountsRepeatedRequestsAsAttempts(t *testing.T) {
+
+	commandQueue := make(chan Command, 10)
+	requestTracker := NewRequestTracker(commandQueue, -time.Second, 2).(*requestTrackerImpl)
+
+	command := Command{messageType: "RQ", commandName: "zone_info", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{1}}}
+	requestTracker.Register(command)
+	requestTracker.Register(command)
+
+	for _, pendingRequest := range requestTracker.pendingRequests {
+		if pendingRequest.attempts != 2 {
+			t.Errorf("expected 2 attempts, got %v", pendingRequest.attempts)
+		}
+	}
+
+	// having reached the maximum number of attempts it gives up instead of retrying
+	requestTracker.CheckTimeouts()
+	if len(commandQueue) != 0 {
+		t.Errorf("expected no retries, got %v", len(commandQueue))
+	}
+}
+
+func TestRequestTrackerResolvesWriteAndRequestWithOneResponse(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		write    Command
+		request  Command
+		response Message
+	}{
+		{
+			name:     "controller mode",
+			write:    Command{messageType: "W", commandName: "controller_mode", destinationID: "01:160371", payload: &ControllerModePayload{Mode: "eco"}},
+			request:  Command{messageType: "RQ", commandName: "controller_mode", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{255}}},
+			response: Message{messageType: "RP", command: "2E04", source: "01:160371", payload: "02FFFFFFFFFFFF00"},
+		},
+		{
+			name:     "dhw state",
+			write:    Command{messageType: "W", commandName: "dhw_state", destinationID: "01:160371", payload: &DhwStatePayload{Mode: "follow_schedule"}},
+			request:  Command{messageType: "RQ", commandName: "dhw_state", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{0}}},
+			response: Message{messageType: "RP", command: "1F41", source: "01:160371", payload: "000000FFFFFF"},
+		},
+		{
+			name:     "dhw settings",
+			write:    Command{messageType: "W", commandName: "dhw_settings", destinationID: "01:160371", payload: &DhwSettingsPayload{Setpoint: 50, Overrun: 5, Differential: 10}},
+			request:  Command{messageType: "RQ", commandName: "dhw_settings", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{0}}},
+			response: Message{messageType: "RP", command: "10A0", source: "01:160371", payload: "0013880503E8"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commandQueue := make(chan Command, 10)
+			requestTracker := NewRequestTracker(commandQueue, -time.Second, 3)
+			requestTracker.Register(test.write)
+			requestTracker.Register(test.request)
+
+			// act
+			requestTracker.Resolve(test.response)
+
+			if requestTracker.PendingCount() != 0 {
+				t.Errorf("expected no pending requests, got %v", requestTracker.PendingCount())
+			}
+			requestTracker.CheckTimeouts()
+			if len(commandQueue) != 0 {
+				t.Errorf("expected no retries, got %v", len(commandQueue))
+			}
+		})
+	}
+}
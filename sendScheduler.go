@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SendScheduler is the interface for deciding which queued command can be transmitted and when
+type SendScheduler interface {
+	Next() (command Command, ok bool)
+	Sent(command Command)
+	ObserveMessage(message Message)
+	QueueDepth() (interactive, background int)
+}
+
+type transmission struct {
+	sentAt  time.Time
+	airtime time.Duration
+}
+
+type syncCycle struct {
+	nextSyncAt   time.Time
+	syncInterval time.Duration
+}
+
+type sendSchedulerImpl struct {
+	controllerIDs      []string
+	commandQueue       chan Command
+	interactiveQueue   []Command
+	backgroundQueue    []Command
+	transmissions      []transmission
+	dutyCycleBudget    time.Duration
+	minInterval        time.Duration
+	syncGuard          time.Duration
+	lastSentAt         time.Time
+	syncCycles         map[string]*syncCycle
+	budgetExhaustedLog time.Time
+	mutex              sync.Mutex
+}
+
+// NewSendScheduler returns new SendScheduler, keeping clear of the sync cycle of each of the controllers
+func NewSendScheduler(controllerIDs []string, commandQueue chan Command, dutyCyclePercentage float64, minInterval, syncGuard time.Duration) SendScheduler {
+	return &sendSchedulerImpl{
+		controllerIDs:   controllerIDs,
+		syncCycles:      map[string]*syncCycle{},
+		commandQueue:    commandQueue,
+		dutyCycleBudget: time.Duration(float64(time.Hour) * dutyCyclePercentage / 100),
+		minInterval:     minInterval,
+		syncGuard:       syncGuard,
+	}
+}
+
+func (ss *sendSchedulerImpl) Next() (command Command, ok bool) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.drainCommandQueue()
+	defer ss.updateQueueDepthMetrics()
+
+	// interactive writes go before background polling
+	queue := &ss.interactiveQueue
+	if len(*queue) == 0 {
+		queue = &ss.backgroundQueue
+	}
+	if len(*queue) == 0 {
+		return command, false
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(ss.lastSentAt) < ss.minInterval {
+		return command, false
+	}
+
+	command = (*queue)[0]
+	if ss.isInSyncWindow(command.destinationID, now) {
+		return command, false
+	}
+	if ss.usedAirtime(now)+estimateAirtime(command) > ss.dutyCycleBudget {
+		// avoid flooding the log while waiting for budget to free up
+		if now.Sub(ss.budgetExhaustedLog) > time.Minute {
+			log.Warn().
+				Dur("budget", ss.dutyCycleBudget).
+				Int("interactiveQueueDepth", len(ss.interactiveQueue)).
+				Int("backgroundQueueDepth", len(ss.backgroundQueue)).
+				Msg("Duty cycle budget exhausted, holding back commands...")
+			ss.budgetExhaustedLog = now
+		}
+		return command, false
+	}
+
+	*queue = (*queue)[1:]
+
+	return command, true
+}
+
+func (ss *sendSchedulerImpl) Sent(command Command) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	now := time.Now().UTC()
+	ss.lastSentAt = now
+	ss.transmissions = append(ss.transmissions, transmission{
+		sentAt:  now,
+		airtime: estimateAirtime(command),
+	})
+}
+
+func (ss *sendSchedulerImpl) ObserveMessage(message Message) {
+
+	if strings.ToUpper(message.command) != "1F09" || !ss.isController(message.source) || message.messageType != "I" || message.payloadLength != 3 {
+		return
+	}
+
+	// 045  I --- 01:160371 --:------ 01:160371 1F09 003 FF073F
+	// payload has the countdown to the next sync cycle in tenths of a second in byte 2 and 3
+	countdown, err := strconv.ParseInt(message.payload[2:6], 16, 64)
+	if err != nil {
+		return
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	syncInterval := time.Duration(countdown) * 100 * time.Millisecond
+	ss.syncCycles[message.source] = &syncCycle{
+		nextSyncAt:   time.Now().UTC().Add(syncInterval),
+		syncInterval: syncInterval,
+	}
+}
+
+func (ss *sendSchedulerImpl) QueueDepth() (interactive, background int) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	return len(ss.interactiveQueue), len(ss.backgroundQueue) + len(ss.commandQueue)
+}
+
+func (ss *sendSchedulerImpl) drainCommandQueue() {
+	for {
+		select {
+		case command := <-ss.commandQueue:
+			if command.messageType == "W" || command.interactive {
+				ss.interactiveQueue = append(ss.interactiveQueue, command)
+			} else {
+				ss.backgroundQueue = append(ss.backgroundQueue, command)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (ss *sendSchedulerImpl) isController(deviceID string) bool {
+	for _, controllerID := range ss.controllerIDs {
+		if deviceID == controllerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (ss *sendSchedulerImpl) isInSyncWindow(controllerID string, now time.Time) bool {
+
+	cycle, ok := ss.syncCycles[controllerID]
+	if !ok || cycle.syncInterval <= 0 {
+		return false
+	}
+
+	// move the expected sync forward when a sync broadcast got missed
+	for now.Sub(cycle.nextSyncAt) > ss.syncGuard {
+		cycle.nextSyncAt = cycle.nextSyncAt.Add(cycle.syncInterval)
+	}
+
+	return now.After(cycle.nextSyncAt.Add(-ss.syncGuard))
+}
+
+func (ss *sendSchedulerImpl) usedAirtime(now time.Time) (airtime time.Duration) {
+
+	// only keep transmissions of the last hour
+	for len(ss.transmissions) > 0 && now.Sub(ss.transmissions[0].sentAt) > time.Hour {
+		ss.transmissions = ss.transmissions[1:]
+	}
+
+	for _, t := range ss.transmissions {
+		airtime += t.airtime
+	}
+
+	return
+}
+
+func (ss *sendSchedulerImpl) updateQueueDepthMetrics() {
+	commandQueueDepth.WithLabelValues("interactive").Set(float64(len(ss.interactiveQueue)))
+	commandQueueDepth.WithLabelValues("background").Set(float64(len(ss.backgroundQueue)))
+}
+
+// estimateAirtime calculates the time on air for a command at 38400 baud, with each byte taking 10 bits that are manchester encoded
+func estimateAirtime(command Command) time.Duration {
+
+	payloadLength := 1
+	if command.payload != nil {
+		payloadLength = len(command.payload.GetPayloadHex()) / 2
+	}
+
+	// preamble, sync word, header, addresses, command code, length and checksum add up to about 20 bytes
+	frameLength := 20 + payloadLength
+
+	return time.Duration(frameLength*20) * time.Second / 38400
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendSchedulerNext(t *testing.T) {
+
+	request := Command{messageType: "RQ", commandName: "zone_name", destinationID: "01:160371", payload: &DefaultPayload{Values: []int{0, 0}}}
+	write := Command{messageType: "W", commandName: "controller_mode", destinationID: "01:160371", payload: &ControllerModePayload{Mode: "eco"}}
+
+	tests := []struct {
+		name                string
+		commands            []Command
+		transmissionsAgo    []time.Duration
+		transmissionAirtime time.Duration
+		lastSentAgo         time.Duration
+		nextSyncIn          *time.Duration
+		syncMessage         *Message
+		expectedOK          bool
+		expectedCommandName string
+	}{
+		{name: "nothing queued", expectedOK: false},
+		{name: "budget available", commands: []Command{request}, expectedOK: true, expectedCommandName: "zone_name"},
+		{name: "writes go before polling", commands: []Command{request, write}, expectedOK: true, expectedCommandName: "controller_mode"},
+		{name: "too soon after the last command", commands: []Command{request}, lastSentAgo: 100 * time.Millisecond, expectedOK: false},
+		{name: "budget exhausted", commands: []Command{request}, transmissionsAgo: []time.Duration{10 * time.Minute, 20 * time.Minute}, transmissionAirtime: 18 * time.Second, expectedOK: false},
+		{name: "budget nearly exhausted", commands: []Command{request}, transmissionsAgo: []time.Duration{10 * time.Minute}, transmissionAirtime: 35 * time.Second, expectedOK: true, expectedCommandName: "zone_name"},
+		{name: "budget refilled after an hour", commands: []Command{request}, transmissionsAgo: []time.Duration{61 * time.Minute, 70 * time.Minute}, transmissionAirtime: 18 * time.Second, expectedOK: true, expectedCommandName: "zone_name"},
+		{name: "sync coming up", commands: []Command{write}, nextSyncIn: durationPointer(time.Second), expectedOK: false},
+		{name: "sync far away", commands: []Command{write}, nextSyncIn: durationPointer(time.Minute), expectedOK: true, expectedCommandName: "controller_mode"},
+		{name: "sync broadcast missed", commands: []Command{write}, nextSyncIn: durationPointer(-179 * time.Second), expectedOK: false},
+		{name: "sync announced by controller", commands: []Command{request}, syncMessage: &Message{messageType: "I", command: "1F09", source: "01:160371", payloadLength: 3, payload: "FF0014"}, expectedOK: false},
+		{name: "sync announced by other controller", commands: []Command{request}, syncMessage: &Message{messageType: "I", command: "1F09", source: "01:999999", payloadLength: 3, payload: "FF0014"}, expectedOK: true, expectedCommandName: "zone_name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commandQueue := make(chan Command, 10)
+			sendScheduler := NewSendScheduler([]string{"01:160371"}, commandQueue, 1, time.Second, 5*time.Second).(*sendSchedulerImpl)
+
+			now := time.Now().UTC()
+			for _, ago := range test.transmissionsAgo {
+				sendScheduler.transmissions = append([]transmission{{sentAt: now.Add(-ago), airtime: test.transmissionAirtime}}, sendScheduler.transmissions...)
+			}
+			if test.lastSentAgo > 0 {
+				sendScheduler.lastSentAt = now.Add(-test.lastSentAgo)
+			}
+			if test.nextSyncIn != nil {
+				sendScheduler.syncCycles["01:160371"] = &syncCycle{nextSyncAt: now.Add(*test.nextSyncIn), syncInterval: 180 * time.Second}
+			}
+			if test.syncMessage != nil {
+				sendScheduler.ObserveMessage(*test.syncMessage)
+			}
+			for _, command := range test.commands {
+				commandQueue <- command
+			}
+
+			// act
+			command, ok := sendScheduler.Next()
+
+			if ok != test.expectedOK {
+				t.Fatalf("expected ok %v, got %v", test.expectedOK, ok)
+			}
+			if ok && command.commandName != test.expectedCommandName {
+				t.Errorf("expected %v command, got %v", test.expectedCommandName, command.commandName)
+			}
+			if interactive, background := sendScheduler.QueueDepth(); ok && interactive+background != len(test.commands)-1 {
+				t.Errorf("expected the sent command to leave the queue, got %v commands queued", interactive+background)
+			}
+		})
+	}
+}
+
+func durationPointer(d time.Duration) *time.Duration {
+	return &d
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+type serialTransportImpl struct {
+	devicePath string
+	port       io.ReadWriteCloser
+	lineReader *lineReader
+}
+
+// NewSerialTransport returns a Transport for a gateway connected to a local serial port
+func NewSerialTransport(devicePath string) Transport {
+	return &serialTransportImpl{
+		devicePath: devicePath,
+	}
+}
+
+func (st *serialTransportImpl) Open() error {
+	options := serial.OpenOptions{
+		PortName:               st.devicePath,
+		BaudRate:               115200,
+		DataBits:               8,
+		StopBits:               1,
+		MinimumReadSize:        0,
+		InterCharacterTimeout:  2000,
+		ParityMode:             serial.PARITY_NONE,
+		Rs485Enable:            false,
+		Rs485RtsHighDuringSend: false,
+		Rs485RtsHighAfterSend:  false,
+	}
+
+	port, err := serial.Open(options)
+	if err != nil {
+		return err
+	}
+
+	st.port = port
+	st.lineReader = newLineReader(bufio.NewReader(port))
+
+	return nil
+}
+
+func (st *serialTransportImpl) Close() error {
+	if st.port == nil {
+		return nil
+	}
+
+	err := st.port.Close()
+	st.port = nil
+
+	// give the device time to settle before reopening it
+	time.Sleep(5 * time.Second)
+
+	return err
+}
+
+func (st *serialTransportImpl) ReadLine() (string, time.Time, error) {
+	line, err := st.lineReader.readLine()
+	return line, time.Now().UTC(), err
+}
+
+func (st *serialTransportImpl) WriteLine(line string) error {
+	_, err := st.port.Write([]byte(line + "\r\n"))
+	return err
+}
+
+func (st *serialTransportImpl) String() string {
+	return fmt.Sprintf("serial://%v", st.devicePath)
+}
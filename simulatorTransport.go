@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var simulatedZoneNames = []string{"Woonkamer", "Keuken", "Slaapkamer", "Badkamer", "Studeerkamer", "Logeerkamer", "Zolder", "Hal", "Bijkeuken", "Kinderkamer", "Washok", "Serre"}
+
+type simulatedZone struct {
+	id          int
+	name        string
+	minimum     float64
+	maximum     float64
+	temperature float64
+	setpoint    float64
+	override    float64
+	heatDemand  float64
+	trvIDs      []string
+}
+
+type simulatorTransportImpl struct {
+	controllerID   string
+	gatewayID      string
+	relayIDs       []string
+	otbID          string
+	dhwSensorID    string
+	zones          []*simulatedZone
+	controllerMode string
+	dhwActive      bool
+	dhwMode        string
+	dhwSetpoint    float64
+	dhwTemperature float64
+	cycleDuration  time.Duration
+	lines          chan string
+	done           chan struct{}
+	mutex          sync.Mutex
+}
+
+// NewSimulatorTransport returns a Transport emulating an evohome controller with zones, trvs, relays and an opentherm bridge, broadcasting a sync cycle every 3 minutes divided by speed
+func NewSimulatorTransport(controllerID, gatewayID string, zones, trvsPerZone, relays int, otb bool, speed float64) Transport {
+
+	st := &simulatorTransportImpl{
+		controllerID:   controllerID,
+		gatewayID:      gatewayID,
+		controllerMode: "00",
+		dhwMode:        "00",
+		dhwSetpoint:    50,
+		dhwTemperature: 45,
+		cycleDuration:  time.Duration(float64(180*time.Second) / speed),
+	}
+
+	for i := 0; i < zones && i < len(simulatedZoneNames); i++ {
+		zone := &simulatedZone{
+			id:          i,
+			name:        simulatedZoneNames[i],
+			minimum:     5,
+			maximum:     30,
+			temperature: 18 + float64(i%3),
+			setpoint:    20,
+		}
+		for j := 0; j < trvsPerZone; j++ {
+			zone.trvIDs = append(zone.trvIDs, fmt.Sprintf("04:%06d", 100000+i*10+j))
+		}
+		st.zones = append(st.zones, zone)
+	}
+	for i := 0; i < relays; i++ {
+		st.relayIDs = append(st.relayIDs, fmt.Sprintf("13:%06d", 100000+i))
+	}
+	if otb {
+		st.otbID = "10:100000"
+	}
+	st.dhwSensorID = "07:100000"
+
+	return st
+}
+
+// newSimulatorTransportFromURL reads the simulator settings from a url like sim://01:123456?zones=6&trvs=1&relays=1&otb=true&speed=1&gateway=18:123456
+func newSimulatorTransportFromURL(u *url.URL) (Transport, error) {
+
+	query := u.Query()
+
+	controllerID := u.Host
+	if controllerID == "" {
+		controllerID = "01:100000"
+	}
+	gatewayID := query.Get("gateway")
+	if gatewayID == "" {
+		gatewayID = "18:100000"
+	}
+
+	intSettings := map[string]int{"zones": 6, "trvs": 1, "relays": 1}
+	for key := range intSettings {
+		if query.Get(key) != "" {
+			value, err := strconv.Atoi(query.Get(key))
+			if err != nil {
+				return nil, err
+			}
+			intSettings[key] = value
+		}
+	}
+
+	otb := query.Get("otb") != "false"
+
+	speed := 1.0
+	if query.Get("speed") != "" {
+		var err error
+		speed, err = strconv.ParseFloat(query.Get("speed"), 64)
+		if err != nil || speed <= 0 {
+			return nil, fmt.Errorf("Simulator speed %v is invalid", query.Get("speed"))
+		}
+	}
+
+	return NewSimulatorTransport(controllerID, gatewayID, intSettings["zones"], intSettings["trvs"], intSettings["relays"], otb, speed), nil
+}
+
+func (st *simulatorTransportImpl) Open() error {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.lines = make(chan string, 100)
+	st.done = make(chan struct{})
+
+	go st.runCycles(st.lines, st.done)
+
+	return nil
+}
+
+func (st *simulatorTransportImpl) Close() error {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.done == nil {
+		return nil
+	}
+
+	close(st.done)
+	st.done = nil
+
+	return nil
+}
+
+func (st *simulatorTransportImpl) ReadLine() (string, time.Time, error) {
+
+	st.mutex.Lock()
+	lines := st.lines
+	st.mutex.Unlock()
+
+	// time out like the serial port does, to give the caller the chance to send commands
+	select {
+	case line := <-lines:
+		return line, time.Now().UTC(), nil
+	case <-time.After(2 * time.Second):
+		return "", time.Time{}, io.EOF
+	}
+}
+
+func (st *simulatorTransportImpl) WriteLine(line string) error {
+
+	// > RQ --- 18:730 01:160371 --:------ 0004 002 0600
+	fields := strings.Fields(line)
+	if len(fields) != 8 {
+		return fmt.Errorf("Command %v has an invalid format", line)
+	}
+	messageType, destination, command, payload := fields[0], fields[3], strings.ToUpper(fields[5]), strings.ToUpper(fields[7])
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	// echo the command like the gateway does, with its own id as source
+	st.emit(st.lines, st.frame(messageType, st.gatewayID, destination, command, payload))
+
+	if destination != st.controllerID {
+		return nil
+	}
+
+	switch messageType {
+	case "RQ":
+		if response := st.respond(command, payload); response != "" {
+			st.emit(st.lines, st.frame("RP", st.controllerID, st.gatewayID, command, response))
+		}
+	case "W":
+		if response := st.write(command, payload); response != "" {
+			st.emit(st.lines, st.frame("I", st.controllerID, st.controllerID, command, response))
+		}
+	}
+
+	return nil
+}
+
+func (st *simulatorTransportImpl) String() string {
+	return fmt.Sprintf("sim://%v?zones=%v&cycle=%v", st.controllerID, len(st.zones), st.cycleDuration)
+}
+
+func (st *simulatorTransportImpl) runCycles(lines chan string, done chan struct{}) {
+
+	for {
+		st.mutex.Lock()
+		st.updateZones()
+		frames := st.cycleFrames()
+		st.mutex.Unlock()
+
+		// spread the frames of a cycle over its first seconds like real devices do
+		interval := st.cycleDuration / time.Duration(10*(len(frames)+1))
+		for _, frame := range frames {
+			select {
+			case <-done:
+				return
+			case <-time.After(interval):
+				st.emit(lines, frame)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(st.cycleDuration - interval*time.Duration(len(frames))):
+		}
+	}
+}
+
+// updateZones moves zone temperatures towards the setpoint when there's heat demand and lets them cool down otherwise
+func (st *simulatorTransportImpl) updateZones() {
+
+	for _, zone := range st.zones {
+		zone.setpoint = st.scheduledSetpoint(zone)
+		if zone.override > 0 {
+			zone.setpoint = zone.override
+		}
+
+		if zone.setpoint > zone.temperature {
+			zone.heatDemand = math.Min(100, math.Round((zone.setpoint-zone.temperature)*100))
+			zone.temperature += 0.1
+		} else {
+			zone.heatDemand = 0
+			zone.temperature -= 0.05
+		}
+	}
+
+	if st.dhwMode == "00" || st.dhwActive {
+		st.dhwTemperature = math.Min(st.dhwSetpoint, st.dhwTemperature+0.5)
+	} else {
+		st.dhwTemperature -= 0.1
+	}
+}
+
+func (st *simulatorTransportImpl) scheduledSetpoint(zone *simulatedZone) float64 {
+
+	switch st.controllerMode {
+	case "01":
+		return zone.minimum
+	case "02":
+		return 17
+	case "03":
+		return 15
+	}
+
+	hour := time.Now().Hour()
+	if hour >= 7 && hour < 23 {
+		return 20 + float64(zone.id%2)
+	}
+
+	return 16
+}
+
+func (st *simulatorTransportImpl) cycleFrames() (frames []string) {
+
+	// sync announcing the next cycle in tenths of a second
+	frames = append(frames, st.frame("I", st.controllerID, st.controllerID, "1F09", fmt.Sprintf("FF%04X", int(st.cycleDuration/(100*time.Millisecond)))))
+
+	setpoints := ""
+	temperatures := ""
+	for _, zone := range st.zones {
+		setpoints += fmt.Sprintf("%02X%04X", zone.id, int(math.Round(zone.setpoint*100)))
+		temperatures += fmt.Sprintf("%02X%04X", zone.id, int(math.Round(zone.temperature*100)))
+	}
+	if len(st.zones) > 0 {
+		frames = append(frames, st.frame("I", st.controllerID, st.controllerID, "2309", setpoints))
+		frames = append(frames, st.frame("I", st.controllerID, st.controllerID, "30C9", temperatures))
+	}
+
+	maxHeatDemand := 0.0
+	for _, zone := range st.zones {
+		for _, trvID := range zone.trvIDs {
+			frames = append(frames, st.frame("I", trvID, st.controllerID, "3150", fmt.Sprintf("%02X%02X", zone.id, int(zone.heatDemand*2))))
+		}
+		maxHeatDemand = math.Max(maxHeatDemand, zone.heatDemand)
+	}
+
+	for _, relayID := range st.relayIDs {
+		frames = append(frames, st.frame("I", st.controllerID, relayID, "0008", fmt.Sprintf("FC%02X", int(maxHeatDemand*2))))
+	}
+	if st.otbID != "" {
+		frames = append(frames, st.frame("RP", st.otbID, st.controllerID, "3EF0", fmt.Sprintf("00%02X10", int(maxHeatDemand))))
+	}
+
+	frames = append(frames, st.frame("I", st.dhwSensorID, st.dhwSensorID, "1260", fmt.Sprintf("00%04X", int(math.Round(st.dhwTemperature*100)))))
+
+	return frames
+}
+
+func (st *simulatorTransportImpl) respond(command, payload string) string {
+
+	if len(payload) < 2 {
+		return ""
+	}
+
+	zone := st.zoneFromPayload(payload)
+
+	switch command {
+	case "0004":
+		if zone == nil {
+			// unused zones have an empty name
+			return payload[0:2] + "00" + strings.Repeat("00", 20)
+		}
+		name := hex.EncodeToString([]byte(zone.name))
+		return strings.ToUpper(fmt.Sprintf("%02X00%v", zone.id, name+strings.Repeat("00", 20-len(zone.name))))
+	case "000A":
+		if zone == nil {
+			// unused zones have no minimum and maximum
+			return payload[0:2] + "107FFF7FFF"
+		}
+		return fmt.Sprintf("%02X10%04X%04X", zone.id, int(math.Round(zone.minimum*100)), int(math.Round(zone.maximum*100)))
+	case "2309":
+		if zone == nil {
+			return ""
+		}
+		return fmt.Sprintf("%02X%04X", zone.id, int(math.Round(zone.setpoint*100)))
+	case "30C9":
+		if zone == nil {
+			return ""
+		}
+		return fmt.Sprintf("%02X%04X", zone.id, int(math.Round(zone.temperature*100)))
+	case "0418":
+		// empty fault log entry
+		if len(payload) != 6 {
+			return ""
+		}
+		return fmt.Sprintf("0000%vB0000000000000000000007FFFFF7000000000", payload[4:6])
+	case "10E0":
+		return "000002FF0163FFFFFFFF140B07E1010807DD45766F20436F6C6F720000000000000000000000"
+	case "2E04":
+		return st.controllerMode + "FFFFFFFFFFFF00"
+	case "1F41":
+		return fmt.Sprintf("00%v%vFFFFFF", st.dhwState(), st.dhwMode)
+	case "10A0":
+		return fmt.Sprintf("00%04X0003E8", int(math.Round(st.dhwSetpoint*100)))
+	case "1260":
+		return fmt.Sprintf("00%04X", int(math.Round(st.dhwTemperature*100)))
+	}
+
+	return ""
+}
+
+func (st *simulatorTransportImpl) write(command, payload string) string {
+
+	switch command {
+	case "2E04":
+		if len(payload) == 16 {
+			st.controllerMode = payload[0:2]
+			return payload
+		}
+	case "1F41":
+		if len(payload) >= 12 {
+			st.dhwActive = payload[2:4] == "01"
+			st.dhwMode = payload[4:6]
+			return payload
+		}
+	case "2349":
+		if zone := st.zoneFromPayload(payload); zone != nil && len(payload) >= 14 {
+			zone.override = 0
+			if payload[6:8] != "00" {
+				setpoint, _ := strconv.ParseInt(payload[2:6], 16, 64)
+				zone.override = float64(setpoint) / 100
+				zone.setpoint = zone.override
+			}
+			return payload
+		}
+	case "10A0":
+		if len(payload) == 12 {
+			setpoint, _ := strconv.ParseInt(payload[2:6], 16, 64)
+			st.dhwSetpoint = float64(setpoint) / 100
+			return payload
+		}
+	}
+
+	return ""
+}
+
+func (st *simulatorTransportImpl) dhwState() string {
+	if st.dhwMode == "00" {
+		return "FF"
+	}
+	if st.dhwActive {
+		return "01"
+	}
+	return "00"
+}
+
+func (st *simulatorTransportImpl) zoneFromPayload(payload string) *simulatedZone {
+
+	if len(payload) < 2 {
+		return nil
+	}
+
+	zoneID, err := strconv.ParseInt(payload[0:2], 16, 64)
+	if err != nil || int(zoneID) >= len(st.zones) {
+		return nil
+	}
+
+	return st.zones[zoneID]
+}
+
+// frame formats a message the way the gateway outputs received frames
+func (st *simulatorTransportImpl) frame(messageType, source, destination, command, payload string) string {
+
+	if source == destination {
+		return fmt.Sprintf("045 %2v --- %v --:------ %v %v %03d %v", messageType, source, destination, command, len(payload)/2, payload)
+	}
+
+	return fmt.Sprintf("045 %2v --- %v %v --:------ %v %03d %v", messageType, source, destination, command, len(payload)/2, payload)
+}
+
+// emit hands a frame to the reader of the channel created by the Open it belongs to, dropping it when nobody reads
+func (st *simulatorTransportImpl) emit(lines chan string, line string) {
+	select {
+	case lines <- line:
+	default:
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// simulatorHarness runs frames from the simulator through the same processing as the listener and sends queued commands back to it
+type simulatorHarness struct {
+	transport        *simulatorTransportImpl
+	frameProcessor   FrameProcessor
+	messageProcessor MessageProcessor
+	stateStore       StateStore
+	measurementSink  *collectingMeasurementSink
+	commandQueue     chan Command
+}
+
+func newSimulatorHarness(t *testing.T) *simulatorHarness {
+
+	// a single cycle takes 10 seconds, with all of its frames in the first second
+	transport := NewSimulatorTransport("01:100000", "18:100000", 3, 1, 1, true, 18).(*simulatorTransportImpl)
+
+	// zone names are known already, so the first cycle gets stored with them
+	stateStore := NewStateStore("01:100000", time.Hour)
+	state := newInitialState()
+	for _, zone := range transport.zones {
+		state.ZoneInfoMap[int64(zone.id)] = ZoneInfo{ID: int64(zone.id), Name: zone.name}
+	}
+	stateStore.Restore(state)
+
+	commandQueue := make(chan Command, 100)
+	measurementSink := &collectingMeasurementSink{}
+	gatewayIdentity := NewGatewayIdentity("")
+	requestTracker := NewRequestTracker(commandQueue, time.Minute, 3)
+	messageProcessor := NewMessageProcessor("01:100000", gatewayIdentity, measurementSink, nil, commandQueue, requestTracker, stateStore)
+	messageRouter := NewMessageRouter([]string{"01:100000"}, map[string]MessageProcessor{"01:100000": messageProcessor})
+
+	if err := transport.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &simulatorHarness{
+		transport:        transport,
+		frameProcessor:   NewFrameProcessor(messageRouter, messageProcessor, gatewayIdentity, NewFrameDeduplicator(time.Second), nil),
+		messageProcessor: messageProcessor,
+		stateStore:       stateStore,
+		measurementSink:  measurementSink,
+		commandQueue:     commandQueue,
+	}
+}
+
+// run processes frames and sends commands until done returns true
+func (sh *simulatorHarness) run(t *testing.T, done func() bool) {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the simulator")
+		}
+
+		select {
+		case command := <-sh.commandQueue:
+			sh.messageProcessor.SendCommand(sh.transport, command)
+		default:
+		}
+
+		line, receivedAt, err := sh.transport.ReadLine()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh.frameProcessor.ProcessFrame(Frame{Line: line, ReceivedAt: receivedAt, Gateway: sh.transport.String()})
+	}
+}
+
+func (sh *simulatorHarness) measurements(name string) map[int64]float64 {
+
+	sh.measurementSink.mutex.Lock()
+	defer sh.measurementSink.mutex.Unlock()
+
+	values := map[int64]float64{}
+	for _, measurement := range sh.measurementSink.measurements {
+		if measurement.Name == name && measurement.ZoneID != nil {
+			values[*measurement.ZoneID] = measurement.Value
+		}
+	}
+
+	return values
+}
+
+func TestSimulatorEndToEnd(t *testing.T) {
+
+	sh := newSimulatorHarness(t)
+	defer sh.transport.Close()
+
+	sh.run(t, func() bool {
+		return len(sh.measurements(measurementTemperature)) == len(sh.transport.zones) && len(sh.measurements(measurementSetpoint)) == len(sh.transport.zones)
+	})
+
+	t.Run("decodes zone temperatures and setpoints", func(t *testing.T) {
+		temperatures := sh.measurements(measurementTemperature)
+		setpoints := sh.measurements(measurementSetpoint)
+
+		sh.transport.mutex.Lock()
+		defer sh.transport.mutex.Unlock()
+		for _, zone := range sh.transport.zones {
+			if expected := math.Round(zone.temperature*100) / 100; temperatures[int64(zone.id)] != expected {
+				t.Errorf("expected temperature %v for zone %v, got %v", expected, zone.id, temperatures[int64(zone.id)])
+			}
+			if expected := math.Round(zone.setpoint*100) / 100; setpoints[int64(zone.id)] != expected {
+				t.Errorf("expected setpoint %v for zone %v, got %v", expected, zone.id, setpoints[int64(zone.id)])
+			}
+		}
+	})
+
+	t.Run("round trips a controller mode change", func(t *testing.T) {
+		if err := sh.messageProcessor.SetControllerMode("eco", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		sh.run(t, func() bool {
+			return sh.stateStore.GetControllerMode().Mode == "eco" && len(sh.commandQueue) == 0
+		})
+
+		sh.transport.mutex.Lock()
+		defer sh.transport.mutex.Unlock()
+		if sh.transport.controllerMode != reverseControllerModeMap["eco"] {
+			t.Errorf("expected the simulated controller to be in mode eco, got %v", controllerModeMap[sh.transport.controllerMode])
+		}
+	})
+
+	t.Run("round trips a zone setpoint override", func(t *testing.T) {
+		if err := sh.messageProcessor.SetZoneSetpoint(1, 22.5, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		sh.run(t, func() bool {
+			zoneInfo, _ := sh.stateStore.GetZoneInfo(1)
+			return zoneInfo.Setpoint == 22.5 && len(sh.commandQueue) == 0
+		})
+	})
+}
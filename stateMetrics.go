@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exportStateMetrics keeps the zone and dhw gauges of a controller in line with its state until the state store stops sending changes
+func exportStateMetrics(controllerID string, stateStore StateStore) {
+
+	changes, unsubscribe := stateStore.Subscribe()
+	defer unsubscribe()
+
+	exporter := &stateMetricsExporter{
+		controllerID: controllerID,
+		zoneLabels:   map[int64][]string{},
+	}
+
+	exporter.exportState(stateStore.Snapshot())
+
+	for change := range changes {
+		switch change.Type {
+		case stateChangeZoneInfo:
+			exporter.exportZoneInfo(change.ZoneInfo)
+		case stateChangeDhwInfo:
+			exporter.exportDhwInfo(change.DhwInfo)
+		case stateChangeRestored:
+			exporter.exportState(stateStore.Snapshot())
+		}
+	}
+}
+
+type stateMetricsExporter struct {
+	controllerID string
+	zoneLabels   map[int64][]string
+}
+
+func (se *stateMetricsExporter) exportState(state State) {
+	for _, zoneInfo := range state.ZoneInfoMap {
+		se.exportZoneInfo(zoneInfo)
+	}
+	se.exportDhwInfo(state.DhwInfo)
+}
+
+func (se *stateMetricsExporter) exportZoneInfo(zoneInfo ZoneInfo) {
+
+	if !zoneInfo.IsActualZone() {
+		return
+	}
+
+	labels := []string{se.controllerID, strconv.FormatInt(zoneInfo.ID, 10), zoneInfo.Name}
+
+	// remove the series under the previous name after a zone got renamed
+	if previousLabels, ok := se.zoneLabels[zoneInfo.ID]; ok && previousLabels[2] != zoneInfo.Name {
+		for _, gauge := range zoneGauges() {
+			gauge.DeleteLabelValues(previousLabels...)
+		}
+	}
+	se.zoneLabels[zoneInfo.ID] = labels
+
+	// only export values that have actually been received, a zero temperature would be misleading; values above 100 are left over from a missing sensor (7FFF) in state stored by older versions
+	if !zoneInfo.Observations.Temperature.UpdatedAt.IsZero() && zoneInfo.Temperature <= 100 {
+		zoneTemperatureCelsius.WithLabelValues(labels...).Set(zoneInfo.Temperature)
+	}
+	if !zoneInfo.Observations.Setpoint.UpdatedAt.IsZero() && zoneInfo.Setpoint <= 100 {
+		zoneSetpointCelsius.WithLabelValues(labels...).Set(zoneInfo.Setpoint)
+	}
+	if !zoneInfo.Observations.HeatDemand.UpdatedAt.IsZero() {
+		zoneHeatDemandPercent.WithLabelValues(labels...).Set(zoneInfo.HeatDemand)
+	}
+	if !zoneInfo.Observations.MinTemperature.UpdatedAt.IsZero() {
+		zoneMinTemperatureCelsius.WithLabelValues(labels...).Set(zoneInfo.MinTemperature)
+	}
+	if !zoneInfo.Observations.MaxTemperature.UpdatedAt.IsZero() {
+		zoneMaxTemperatureCelsius.WithLabelValues(labels...).Set(zoneInfo.MaxTemperature)
+	}
+}
+
+func (se *stateMetricsExporter) exportDhwInfo(dhwInfo DhwInfo) {
+	// mode changes update the dhw info as well, so the temperature might not have been received yet
+	if dhwInfo.UpdatedAt.IsZero() || dhwInfo.Temperature == 0 {
+		return
+	}
+	dhwTemperatureCelsius.WithLabelValues(se.controllerID).Set(dhwInfo.Temperature)
+}
+
+func zoneGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{zoneTemperatureCelsius, zoneSetpointCelsius, zoneHeatDemandPercent, zoneMinTemperatureCelsius, zoneMaxTemperatureCelsius}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExportZoneInfo(t *testing.T) {
+
+	updatedAt := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                string
+		zoneInfo            ZoneInfo
+		expectedTemperature *float64
+		expectedSetpoint    *float64
+	}{
+		{
+			name:                "received values",
+			zoneInfo:            ZoneInfo{ID: 1, Name: "Living", Temperature: 20.5, Setpoint: 19, Observations: ZoneObservations{Temperature: FieldObservation{UpdatedAt: updatedAt}, Setpoint: FieldObservation{UpdatedAt: updatedAt}}},
+			expectedTemperature: floatPointer(20.5),
+			expectedSetpoint:    floatPointer(19),
+		},
+		{
+			name:     "values that haven't been received",
+			zoneInfo: ZoneInfo{ID: 1, Name: "Living"},
+		},
+		{
+			name:     "missing sensor",
+			zoneInfo: ZoneInfo{ID: 1, Name: "Living", Temperature: 327.67, Setpoint: 327.67, Observations: ZoneObservations{Temperature: FieldObservation{UpdatedAt: updatedAt}, Setpoint: FieldObservation{UpdatedAt: updatedAt}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := &stateMetricsExporter{
+				controllerID: "01:" + test.name,
+				zoneLabels:   map[int64][]string{},
+			}
+			labels := []string{exporter.controllerID, "1", "Living"}
+			defer func() {
+				for _, gauge := range zoneGauges() {
+					gauge.DeleteLabelValues(labels...)
+				}
+			}()
+
+			// act
+			exporter.exportZoneInfo(test.zoneInfo)
+
+			assertGauge(t, zoneTemperatureCelsius, labels, test.expectedTemperature)
+			assertGauge(t, zoneSetpointCelsius, labels, test.expectedSetpoint)
+		})
+	}
+}
+
+// assertGauge checks the gauge has the expected value for the labels, or has no series for them if expected is nil
+func assertGauge(t *testing.T, gauge *prometheus.GaugeVec, labels []string, expected *float64) {
+
+	t.Helper()
+
+	if expected == nil {
+		if gauge.DeleteLabelValues(labels...) {
+			t.Errorf("expected no series for %v", labels)
+		}
+		return
+	}
+	if actual := testutil.ToFloat64(gauge.WithLabelValues(labels...)); actual != *expected {
+		t.Errorf("expected %v for %v, got %v", *expected, labels, actual)
+	}
+}
+
+func floatPointer(value float64) *float64 {
+	return &value
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// StatePersister is the interface for keeping state across restarts and sharing it with other applications
+type StatePersister interface {
+	// Load returns the persisted state or nil if nothing has been persisted yet
+	Load() (*State, error)
+	Store(state State) error
+	String() string
+}
+
+// NewStatePersister returns the StatePersister for backend file, configmap or none; the state of the primary controller keeps the original file name and configmap key, any other controller gets its id appended
+func NewStatePersister(backend, controllerID string, primary bool) (StatePersister, error) {
+
+	switch backend {
+	case "file":
+		return NewFileStatePersister(controllerStateFilePath(*stateFilePath, controllerID, primary)), nil
+	case "configmap":
+		return NewConfigMapStatePersister(*namespace, *stateFileConfigMapName, controllerStateFilePath("state.json", controllerID, primary))
+	case "none":
+		return &noopStatePersister{}, nil
+	}
+
+	return nil, fmt.Errorf("State persister %v is not supported", backend)
+}
+
+// controllerStateFilePath appends the controller id to the file name, unless it's the primary controller
+func controllerStateFilePath(path, controllerID string, primary bool) string {
+	if primary {
+		return path
+	}
+
+	extension := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, extension) + "-" + strings.Replace(controllerID, ":", "-", -1) + extension
+}
+
+type noopStatePersister struct {
+}
+
+func (np *noopStatePersister) Load() (*State, error) {
+	return nil, nil
+}
+
+func (np *noopStatePersister) Store(state State) error {
+	return nil
+}
+
+func (np *noopStatePersister) String() string {
+	return "none"
+}
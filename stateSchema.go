@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// currentStateSchemaVersion is the version of the state layout written by this application, described by state.schema.json; bump it and add a migration when changing the layout
+const currentStateSchemaVersion = 2
+
+// stateMigrations upgrade the raw state one version at a time, with the migration at index i taking a state from version i+1 to i+2
+var stateMigrations = []func(rawState map[string]json.RawMessage){
+	// version 1 only had ZoneInfoMap and LastUpdated
+	func(rawState map[string]json.RawMessage) {
+		if _, ok := rawState["ControllerMode"]; !ok {
+			rawState["ControllerMode"] = json.RawMessage("{}")
+		}
+		if _, ok := rawState["DhwInfo"]; !ok {
+			rawState["DhwInfo"] = json.RawMessage("{}")
+		}
+	},
+}
+
+// unmarshalState decodes persisted state of any known schema version; parts that can't be decoded are skipped with a warning instead of failing altogether
+func unmarshalState(data []byte) *State {
+
+	var rawState map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rawState); err != nil {
+		log.Warn().Err(err).Msg("Persisted state is corrupt, starting without it")
+		return nil
+	}
+	if rawState == nil {
+		return nil
+	}
+
+	// state without version predates versioning
+	schemaVersion := 1
+	if rawVersion, ok := rawState["SchemaVersion"]; ok {
+		if err := json.Unmarshal(rawVersion, &schemaVersion); err != nil || schemaVersion < 1 {
+			log.Warn().Err(err).Msg("Persisted state has an invalid schema version, assuming it's the oldest one")
+			schemaVersion = 1
+		}
+	}
+
+	if schemaVersion > currentStateSchemaVersion {
+		log.Warn().Msgf("Persisted state has schema version %v, which is newer than supported version %v; loading what's understood", schemaVersion, currentStateSchemaVersion)
+	}
+
+	for version := schemaVersion; version < currentStateSchemaVersion; version++ {
+		log.Info().Msgf("Migrating persisted state from schema version %v to %v...", version, version+1)
+		stateMigrations[version-1](rawState)
+	}
+
+	state := State{
+		SchemaVersion: currentStateSchemaVersion,
+		ZoneInfoMap:   unmarshalZoneInfoMap(rawState["ZoneInfoMap"]),
+	}
+
+	unmarshalStateField(rawState, "ControllerID", &state.ControllerID)
+	unmarshalStateField(rawState, "ControllerMode", &state.ControllerMode)
+	unmarshalStateField(rawState, "DhwInfo", &state.DhwInfo)
+	unmarshalStateField(rawState, "LastUpdated", &state.LastUpdated)
+
+	return &state
+}
+
+func unmarshalStateField(rawState map[string]json.RawMessage, field string, value interface{}) {
+	rawValue, ok := rawState[field]
+	if !ok {
+		return
+	}
+
+	if err := json.Unmarshal(rawValue, value); err != nil {
+		log.Warn().Err(err).Msgf("Persisted state field %v is corrupt, skipping it", field)
+	}
+}
+
+// unmarshalZoneInfoMap decodes each zone by itself, so one corrupt zone doesn't lose all others
+func unmarshalZoneInfoMap(data json.RawMessage) map[int64]ZoneInfo {
+
+	zoneInfoMap := map[int64]ZoneInfo{}
+	if data == nil {
+		return zoneInfoMap
+	}
+
+	var rawZones map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rawZones); err != nil {
+		log.Warn().Err(err).Msg("Persisted state field ZoneInfoMap is corrupt, skipping it")
+		return zoneInfoMap
+	}
+
+	for key, rawZone := range rawZones {
+		zoneID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Persisted state has invalid zone id %v, skipping it", key)
+			continue
+		}
+
+		var zoneInfo ZoneInfo
+		if err := json.Unmarshal(rawZone, &zoneInfo); err != nil {
+			log.Warn().Err(err).Msgf("Persisted state for zone %v is corrupt, skipping it", zoneID)
+			continue
+		}
+
+		zoneInfoMap[zoneID] = zoneInfo
+	}
+
+	return zoneInfoMap
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StateStore is the interface for sharing zone, controller mode and dhw state between message handlers, persisters and other readers
+type StateStore interface {
+	GetZoneInfo(zoneID int64) (zoneInfo ZoneInfo, known bool)
+	GetZoneInfoMap() map[int64]ZoneInfo
+	UpdateZoneInfo(zoneID int64, update func(zoneInfo *ZoneInfo)) ZoneInfo
+	GetControllerMode() ControllerMode
+	SetControllerMode(controllerMode ControllerMode)
+	GetDhwInfo() DhwInfo
+	UpdateDhwInfo(update func(dhwInfo *DhwInfo)) DhwInfo
+	Snapshot() State
+	Restore(state State)
+	Subscribe() (changes <-chan StateChange, unsubscribe func())
+}
+
+// StateChange is sent to subscribers after part of the state changed
+type StateChange struct {
+	Type           string
+	ZoneID         int64
+	ZoneInfo       ZoneInfo
+	ControllerMode ControllerMode
+	DhwInfo        DhwInfo
+}
+
+const (
+	stateChangeZoneInfo       = "zone_info"
+	stateChangeControllerMode = "controller_mode"
+	stateChangeDhwInfo        = "dhw_info"
+	stateChangeRestored       = "restored"
+)
+
+type stateStoreImpl struct {
+	controllerID   string
+	zoneInfoMap    map[int64]ZoneInfo
+	controllerMode ControllerMode
+	dhwInfo        DhwInfo
+	lastUpdated    time.Time
+	staleAfter     time.Duration
+	subscribers    map[chan StateChange]struct{}
+	mutex          sync.RWMutex
+}
+
+// NewStateStore returns new StateStore for a controller, marking zone values that haven't been received for longer than staleAfter as stale
+func NewStateStore(controllerID string, staleAfter time.Duration) StateStore {
+	return &stateStoreImpl{
+		controllerID: controllerID,
+		staleAfter:   staleAfter,
+		zoneInfoMap:  map[int64]ZoneInfo{},
+		subscribers:  map[chan StateChange]struct{}{},
+	}
+}
+
+func (ss *stateStoreImpl) GetZoneInfo(zoneID int64) (zoneInfo ZoneInfo, known bool) {
+
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	zoneInfo, known = ss.zoneInfoMap[zoneID]
+	zoneInfo = zoneInfo.withStaleness(time.Now().UTC(), ss.staleAfter)
+
+	return
+}
+
+func (ss *stateStoreImpl) GetZoneInfoMap() map[int64]ZoneInfo {
+
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	return ss.copyZoneInfoMap()
+}
+
+func (ss *stateStoreImpl) UpdateZoneInfo(zoneID int64, update func(zoneInfo *ZoneInfo)) ZoneInfo {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	zoneInfo, known := ss.zoneInfoMap[zoneID]
+	if !known {
+		zoneInfo = ZoneInfo{
+			ID: zoneID,
+		}
+	}
+
+	update(&zoneInfo)
+
+	ss.zoneInfoMap[zoneID] = zoneInfo
+	ss.lastUpdated = time.Now().UTC()
+
+	ss.publish(StateChange{
+		Type:     stateChangeZoneInfo,
+		ZoneID:   zoneID,
+		ZoneInfo: zoneInfo,
+	})
+
+	return zoneInfo
+}
+
+func (ss *stateStoreImpl) GetControllerMode() ControllerMode {
+
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	return ss.controllerMode
+}
+
+func (ss *stateStoreImpl) SetControllerMode(controllerMode ControllerMode) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.controllerMode = controllerMode
+	ss.lastUpdated = time.Now().UTC()
+
+	ss.publish(StateChange{
+		Type:           stateChangeControllerMode,
+		ControllerMode: controllerMode,
+	})
+}
+
+func (ss *stateStoreImpl) GetDhwInfo() DhwInfo {
+
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	return ss.dhwInfo
+}
+
+func (ss *stateStoreImpl) UpdateDhwInfo(update func(dhwInfo *DhwInfo)) DhwInfo {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	update(&ss.dhwInfo)
+	ss.lastUpdated = time.Now().UTC()
+
+	ss.publish(StateChange{
+		Type:    stateChangeDhwInfo,
+		DhwInfo: ss.dhwInfo,
+	})
+
+	return ss.dhwInfo
+}
+
+func (ss *stateStoreImpl) Snapshot() State {
+
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	return State{
+		SchemaVersion:  currentStateSchemaVersion,
+		ControllerID:   ss.controllerID,
+		ZoneInfoMap:    ss.copyZoneInfoMap(),
+		ControllerMode: ss.controllerMode,
+		DhwInfo:        ss.dhwInfo,
+		LastUpdated:    ss.lastUpdated,
+	}
+}
+
+func (ss *stateStoreImpl) Restore(state State) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.zoneInfoMap = map[int64]ZoneInfo{}
+	for zoneID, zoneInfo := range state.ZoneInfoMap {
+		ss.zoneInfoMap[zoneID] = zoneInfo
+	}
+	ss.controllerMode = state.ControllerMode
+	ss.dhwInfo = state.DhwInfo
+	ss.lastUpdated = state.LastUpdated
+
+	ss.publish(StateChange{
+		Type: stateChangeRestored,
+	})
+}
+
+func (ss *stateStoreImpl) Subscribe() (changes <-chan StateChange, unsubscribe func()) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	subscriber := make(chan StateChange, 100)
+	ss.subscribers[subscriber] = struct{}{}
+
+	var once sync.Once
+	unsubscribe = func() {
+		once.Do(func() {
+			ss.mutex.Lock()
+			defer ss.mutex.Unlock()
+
+			delete(ss.subscribers, subscriber)
+			close(subscriber)
+		})
+	}
+
+	return subscriber, unsubscribe
+}
+
+// publish hands the change to all subscribers without blocking the caller; needs to be called while holding the lock
+func (ss *stateStoreImpl) publish(change StateChange) {
+	for subscriber := range ss.subscribers {
+		select {
+		case subscriber <- change:
+		default:
+			log.Warn().Str("type", change.Type).Msg("State change subscriber isn't keeping up, dropping change")
+		}
+	}
+}
+
+func (ss *stateStoreImpl) copyZoneInfoMap() map[int64]ZoneInfo {
+	now := time.Now().UTC()
+	zoneInfoMap := make(map[int64]ZoneInfo, len(ss.zoneInfoMap))
+	for zoneID, zoneInfo := range ss.zoneInfoMap {
+		zoneInfoMap[zoneID] = zoneInfo.withStaleness(now, ss.staleAfter)
+	}
+
+	return zoneInfoMap
+}
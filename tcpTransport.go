@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+type tcpTransportImpl struct {
+	address    string
+	conn       net.Conn
+	lineReader *lineReader
+}
+
+// NewTCPTransport returns a Transport for a gateway exposed over raw tcp, for example by ser2net or an esp bridge
+func NewTCPTransport(address string) Transport {
+	return &tcpTransportImpl{
+		address: address,
+	}
+}
+
+func (tt *tcpTransportImpl) Open() error {
+	conn, err := net.DialTimeout("tcp", tt.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	tt.conn = conn
+	tt.lineReader = newLineReader(bufio.NewReader(conn))
+
+	return nil
+}
+
+func (tt *tcpTransportImpl) Close() error {
+	if tt.conn == nil {
+		return nil
+	}
+
+	err := tt.conn.Close()
+	tt.conn = nil
+
+	return err
+}
+
+func (tt *tcpTransportImpl) ReadLine() (string, time.Time, error) {
+
+	// time out like the serial port does, to give the caller the chance to send commands
+	err := tt.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	line, err := tt.lineReader.readLine()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "", time.Time{}, io.EOF
+	}
+
+	return line, time.Now().UTC(), err
+}
+
+func (tt *tcpTransportImpl) WriteLine(line string) error {
+	_, err := tt.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+func (tt *tcpTransportImpl) String() string {
+	return fmt.Sprintf("tcp://%v", tt.address)
+}
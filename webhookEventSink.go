@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook is an http endpoint events get posted to, optionally limited to some event types and signed with a secret
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type webhookEndpoint struct {
+	webhook Webhook
+	target  string
+	events  map[string]bool
+	queue   chan Event
+}
+
+type webhookEventSinkImpl struct {
+	endpoints   []*webhookEndpoint
+	maxAttempts int
+	httpClient  *http.Client
+	done        chan struct{}
+	closed      bool
+	mutex       sync.RWMutex
+	waitGroup   sync.WaitGroup
+}
+
+// NewWebhookEventSink returns an EventSink posting events as json to the webhooks interested in them from a background goroutine per webhook, retrying with backoff up to maxAttempts times; events are dropped when a webhook falls too far behind
+func NewWebhookEventSink(webhooks []Webhook, timeout time.Duration, maxAttempts int) (EventSink, error) {
+
+	ws := &webhookEventSinkImpl{
+		maxAttempts: maxAttempts,
+		httpClient:  &http.Client{Timeout: timeout},
+		done:        make(chan struct{}),
+	}
+
+	for _, webhook := range webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Webhook url %v is not a valid http or https url", webhook.URL)
+		}
+
+		// an empty filter means all events
+		var events map[string]bool
+		for _, eventType := range webhook.Events {
+			if !isEventType(eventType) {
+				return nil, fmt.Errorf("Event %v of webhook %v is unknown, it should be one of %v", eventType, webhook.URL, strings.Join(eventTypes, ", "))
+			}
+			if events == nil {
+				events = map[string]bool{}
+			}
+			events[eventType] = true
+		}
+
+		ws.endpoints = append(ws.endpoints, &webhookEndpoint{
+			webhook: webhook,
+			// leave out the query, which might hold a token
+			target: u.Scheme + "://" + u.Host + u.Path,
+			events: events,
+			queue:  make(chan Event, 100),
+		})
+	}
+
+	for _, endpoint := range ws.endpoints {
+		ws.waitGroup.Add(1)
+		go ws.run(endpoint)
+	}
+
+	return ws, nil
+}
+
+func (ws *webhookEventSinkImpl) Publish(event Event) {
+
+	// the id stays the same across retries, so receivers can drop deliveries they've already handled
+	if event.ID == "" {
+		zoneID := ""
+		if event.ZoneID != nil {
+			zoneID = fmt.Sprint(*event.ZoneID)
+		}
+		event.ID = fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v|%v|%v", event.Type, event.ControllerID, event.DeviceID, zoneID, event.OccurredAt.UnixNano()))))
+	}
+
+	ws.mutex.RLock()
+	defer ws.mutex.RUnlock()
+	if ws.closed {
+		return
+	}
+
+	for _, endpoint := range ws.endpoints {
+		if endpoint.events != nil && !endpoint.events[event.Type] {
+			continue
+		}
+
+		// never hold up message processing for a slow webhook
+		select {
+		case endpoint.queue <- event:
+		default:
+			webhookDeliveriesTotal.WithLabelValues(event.Type, "dropped").Inc()
+			log.Warn().Msgf("Queue of webhook %v is full, dropping %v event", endpoint.target, event.Type)
+		}
+	}
+}
+
+// Close makes a last attempt to deliver queued events without retrying
+func (ws *webhookEventSinkImpl) Close() error {
+
+	ws.mutex.Lock()
+	if ws.closed {
+		ws.mutex.Unlock()
+		return nil
+	}
+	ws.closed = true
+	close(ws.done)
+	for _, endpoint := range ws.endpoints {
+		close(endpoint.queue)
+	}
+	ws.mutex.Unlock()
+
+	ws.waitGroup.Wait()
+
+	return nil
+}
+
+func (ws *webhookEventSinkImpl) String() string {
+
+	targets := []string{}
+	for _, endpoint := range ws.endpoints {
+		targets = append(targets, endpoint.target)
+	}
+
+	return fmt.Sprintf("webhooks %v", strings.Join(targets, ", "))
+}
+
+func (ws *webhookEventSinkImpl) run(endpoint *webhookEndpoint) {
+
+	defer ws.waitGroup.Done()
+
+	for event := range endpoint.queue {
+		ws.deliver(endpoint, event)
+	}
+}
+
+func (ws *webhookEventSinkImpl) deliver(endpoint *webhookEndpoint, event Event) {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed encoding %v event", event.Type)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retryable, err := ws.post(endpoint, event, body)
+		if err == nil {
+			webhookDeliveriesTotal.WithLabelValues(event.Type, "delivered").Inc()
+			log.Debug().Msgf("Delivered %v event %v to webhook %v", event.Type, event.ID, endpoint.target)
+			return
+		}
+
+		if !retryable || attempt >= ws.maxAttempts {
+			webhookDeliveriesTotal.WithLabelValues(event.Type, "failed").Inc()
+			log.Warn().Err(err).Msgf("Failed delivering %v event %v to webhook %v after %v attempts", event.Type, event.ID, endpoint.target, attempt)
+			return
+		}
+
+		log.Debug().Err(err).Msgf("Failed delivering %v event %v to webhook %v, retrying in %v...", event.Type, event.ID, endpoint.target, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ws.done:
+			webhookDeliveriesTotal.WithLabelValues(event.Type, "failed").Inc()
+			log.Warn().Err(err).Msgf("Failed delivering %v event %v to webhook %v before shutting down", event.Type, event.ID, endpoint.target)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the event to the webhook and returns whether a failure is worth retrying
+func (ws *webhookEventSinkImpl) post(endpoint *webhookEndpoint, event Event, body []byte) (retryable bool, err error) {
+
+	request, err := http.NewRequest(http.MethodPost, endpoint.webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "evohome-hgi80-listener")
+	request.Header.Set("X-Evohome-Event", event.Type)
+	request.Header.Set("X-Evohome-Delivery", event.ID)
+
+	// receivers verify the body hasn't been tampered with by computing the same hmac with the shared secret
+	if endpoint.webhook.Secret != "" {
+		request.Header.Set("X-Evohome-Signature-256", "sha256="+signWebhookBody(endpoint.webhook.Secret, body))
+	}
+
+	response, err := ws.httpClient.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return false, nil
+	}
+
+	responseBody, _ := ioutil.ReadAll(response.Body)
+	err = fmt.Errorf("Webhook responded with status %v: %v", response.Status, strings.TrimSpace(string(responseBody)))
+
+	// other client errors won't go away by sending the same request again
+	retryable = response.StatusCode >= 500 || response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests
+
+	return retryable, err
+}
+
+// signWebhookBody returns the hex encoded hmac-sha256 of the body with secret as key
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseWebhooks reads the webhooks from a json array like [{"url": "https://...", "secret": "...", "events": ["battery_low"]}]
+func parseWebhooks(config string) ([]Webhook, error) {
+
+	webhooks := []Webhook{}
+	if strings.TrimSpace(config) == "" {
+		return webhooks, nil
+	}
+
+	if err := json.Unmarshal([]byte(config), &webhooks); err != nil {
+		return nil, fmt.Errorf("Webhooks are not a valid json array: %v", err)
+	}
+
+	return webhooks, nil
+}
+
+func isEventType(eventType string) bool {
+	for _, t := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignWebhookBody(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		secret   string
+		body     string
+		expected string
+	}{
+		{"rfc 4231 test case 2", "Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"empty secret and body", "", "", "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+		{"event body", "secret", `{"id":"1","type":"battery_low"}`, "cda427c69a23e5cab410e1bd5030a5f1acba040009dc6ee3e3113df5140584e6"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := signWebhookBody(test.secret, []byte(test.body)); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWebhookEventSinkSignsDeliveredBody(t *testing.T) {
+
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	deliveries := make(chan delivery, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{body: body, signature: r.Header.Get("X-Evohome-Signature-256")}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookEventSink([]Webhook{{URL: server.URL, Secret: "secret", Events: []string{eventOverrideCleared}}}, time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// act
+	sink.Publish(Event{ID: "1", Type: eventOverrideCleared, ControllerID: "01:160371", OccurredAt: time.Now()})
+
+	select {
+	case d := <-deliveries:
+		if expected := "sha256=" + signWebhookBody("secret", d.body); d.signature != expected {
+			t.Errorf("expected signature %v, got %v", expected, d.signature)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook to be called")
+	}
+}